@@ -3,6 +3,7 @@ package exoip
 import (
 	"errors"
 	"fmt"
+	"net"
 
 	"github.com/exoscale/egoscale"
 )
@@ -24,6 +25,63 @@ func fetchMyInfo(ego *egoscale.Client, instanceID egoscale.UUID) (*egoscale.UUID
 	return vm.ZoneID, nic.ID, nil
 }
 
+// canonicalIP returns the 4-byte form of an IPv4 address and the 16-byte form
+// of an IPv6 one, or nil if ip is not a valid address
+func canonicalIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// holder is a NIC holding an Elastic IP
+type holder struct {
+	VirtualMachine *egoscale.VirtualMachine
+	NicID          *egoscale.UUID
+	// AddressID is the ID of the secondary IP, as needed to remove it
+	AddressID *egoscale.UUID
+}
+
+// String returns a description of the holder, e.g. name (vm: ID, nic: ID)
+func (h holder) String() string {
+	return fmt.Sprintf("%s (vm: %s, nic: %s)", h.VirtualMachine.Name, h.VirtualMachine.ID, h.NicID)
+}
+
+// findHolders looks for the NICs holding the IP among the virtual machines
+func findHolders(vms []interface{}, ip net.IP) []holder {
+	holders := make([]holder, 0)
+	for _, v := range vms {
+		vm := v.(*egoscale.VirtualMachine)
+		for _, nic := range vm.Nic {
+			for _, secIP := range nic.SecondaryIP {
+				if secIP.IPAddress.Equal(ip) {
+					holders = append(holders, holder{
+						VirtualMachine: vm,
+						NicID:          nic.ID,
+						AddressID:      secIP.ID,
+					})
+				}
+			}
+		}
+	}
+	return holders
+}
+
+// holds tells if the given NIC of the virtual machine holds the IP
+func holds(vm *egoscale.VirtualMachine, nicID egoscale.UUID, ip net.IP) bool {
+	for _, nic := range vm.Nic {
+		if !nic.ID.Equal(nicID) {
+			continue
+		}
+		for _, secIP := range nic.SecondaryIP {
+			if secIP.IPAddress.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // VMHasSecurityGroup tells whether the VM has any security groups
 func VMHasSecurityGroup(vm *egoscale.VirtualMachine, sgname string) bool {
 
@@ -44,7 +102,7 @@ func FindPeerNic(ego *egoscale.Client, ip string) (*egoscale.UUID, error) {
 	}
 
 	for _, i := range vms {
-		vm := i.(egoscale.VirtualMachine)
+		vm := i.(*egoscale.VirtualMachine)
 		nic := vm.DefaultNic()
 		if nic != nil && nic.IPAddress != nil && nic.IPAddress.String() == ip {
 			return vm.DefaultNic().ID, nil
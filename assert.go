@@ -10,7 +10,7 @@ func assertSuccessOrExit(err error) {
 	if err == nil {
 		return
 	}
-	Logger.Crit(fmt.Sprintf("fatal: %s", err))
+	Logger.Crit("fatal: %s", err)
 	_, err = fmt.Fprintf(os.Stderr, "fatal error: %s\n", err)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,137 @@
+package exoip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// authTagLength is the size of the HMAC-SHA256 tag appended to a payload
+const authTagLength = sha256.Size
+
+// authWarningInterval is the minimum time between two warnings about
+// unauthenticated payloads
+const authWarningInterval = 10 * time.Second
+
+// ReadAuthKey reads the shared key from the given file
+func ReadAuthKey(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.TrimSpace(string(content))
+	if key == "" {
+		return nil, fmt.Errorf("key file %q is empty", path)
+	}
+
+	return []byte(key), nil
+}
+
+// NextBootID returns the boot ID to use, recording it in the given file
+//
+// The boot ID must grow with every start, whatever the clock says: the
+// peers reject the advertisements of an older boot as replays. It is the
+// given one, the start time, unless the last one recorded isn't older.
+func NextBootID(path string, bootID uint64) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if last := strings.TrimSpace(string(content)); last != "" {
+		previous, err := strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("boot ID file %q is corrupted: %s", path, err)
+		}
+		if previous >= bootID {
+			bootID = previous + 1
+		}
+	}
+
+	// the file is replaced at once, not to be left truncated
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(bootID, 10)+"\n"), 0600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+
+	return bootID, nil
+}
+
+// signPayload writes the HMAC tag of the payload at the end of buf
+//
+// buf must have room for the authTagLength bytes of the tag.
+func signPayload(key, buf []byte) {
+	n := len(buf) - authTagLength
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:n]) // nolint: errcheck, gosec
+	copy(buf[n:], mac.Sum(nil))
+}
+
+// verifyPayload checks the HMAC tag at the end of buf and returns the payload
+func verifyPayload(key, buf []byte) ([]byte, error) {
+	n := len(buf) - authTagLength
+	if n <= 0 {
+		return nil, errors.New("payload is missing its authentication tag")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:n]) // nolint: errcheck, gosec
+	if !hmac.Equal(buf[n:], mac.Sum(nil)) {
+		return nil, errors.New("authentication tag mismatch")
+	}
+
+	return buf[:n], nil
+}
+
+// authorizeRequest tells if the request, e.g. info, may be answered
+//
+// The local requests always are. The others must be signed with the shared
+// key, so that anyone who can reach the port cannot query us.
+func authorizeRequest(key []byte, addr *net.UDPAddr, request []byte, command string) error {
+	if addr.IP.IsLoopback() {
+		return nil
+	}
+	if key == nil {
+		return errors.New("not a local request, a shared key is needed to answer it")
+	}
+
+	data, err := verifyPayload(key, request)
+	if err != nil {
+		return err
+	}
+	if string(data) != command {
+		return fmt.Errorf("unknown request %q", data)
+	}
+	return nil
+}
+
+// rejectUnauthenticated counts the dropped payload and warns about it
+//
+// The warnings are rate limited to one per authWarningInterval so that
+// a flood of forged packets cannot flood the logs.
+func (engine *Engine) rejectUnauthenticated(addr *net.UDPAddr, err error) {
+	total := atomic.AddUint64(&engine.AuthFailures, 1)
+	engine.authSuppressed++
+
+	now := time.Now()
+	if now.Sub(engine.lastAuthWarning) < authWarningInterval {
+		return
+	}
+
+	Logger.Warning("dropped unauthenticated payload from %s: %s (%d since last warning, %d total)",
+		addr.IP, err, engine.authSuppressed, total)
+	engine.lastAuthWarning = now
+	engine.authSuppressed = 0
+}
@@ -0,0 +1,127 @@
+package exoip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func signed(key, payload []byte) []byte {
+	buf := make([]byte, len(payload)+authTagLength)
+	copy(buf, payload)
+	signPayload(key, buf)
+	return buf
+}
+
+func TestVerifyPayload(t *testing.T) {
+	key := []byte("secret")
+	payload := []byte("some advertisement")
+
+	got, err := verifyPayload(key, signed(key, payload))
+	if err != nil {
+		t.Fatalf("signed payload rejected: %s", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got payload %q, want %q", got, payload)
+	}
+}
+
+func TestVerifyPayloadRejects(t *testing.T) {
+	key := []byte("secret")
+	payload := []byte("some advertisement")
+
+	tampered := signed(key, payload)
+	tampered[0] ^= 0xff
+
+	badTag := signed(key, payload)
+	badTag[len(badTag)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		key  []byte
+		buf  []byte
+	}{
+		{"wrong key", []byte("other"), signed(key, payload)},
+		{"tampered payload", key, tampered},
+		{"tampered tag", key, badTag},
+		{"unsigned", key, payload},
+		{"tag only", key, signed(key, nil)},
+		{"empty", key, nil},
+	}
+
+	for _, tt := range tests {
+		if _, err := verifyPayload(tt.key, tt.buf); err == nil {
+			t.Errorf("%s: payload accepted", tt.name)
+		}
+	}
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	key := []byte("secret")
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		addr    *net.UDPAddr
+		request []byte
+		allowed bool
+	}{
+		{"local", nil, local, []byte("info"), true},
+		{"local with a key", key, local, []byte("info"), true},
+		{"remote without a key", nil, remote, []byte("info"), false},
+		{"remote unsigned", key, remote, []byte("info"), false},
+		{"remote signed", key, remote, signed(key, []byte("info")), true},
+		{"remote signed with another key", key, remote, signed([]byte("other"), []byte("info")), false},
+		{"remote signed, other request", key, remote, signed(key, []byte("info please")), false},
+	}
+
+	for _, tt := range tests {
+		err := authorizeRequest(tt.key, tt.addr, tt.request, "info")
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: got allowed %v (%v), want %v", tt.name, allowed, err, tt.allowed)
+		}
+	}
+}
+
+func TestNextBootID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "boot-id")
+
+	// the start time, as long as the clock goes forward
+	for _, start := range []uint64{100, 200} {
+		bootID, err := NextBootID(path, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bootID != start {
+			t.Errorf("got boot ID %d, want %d", bootID, start)
+		}
+	}
+
+	// the clock went back
+	for _, want := range []uint64{201, 202} {
+		bootID, err := NextBootID(path, 150)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bootID != want {
+			t.Errorf("got boot ID %d, want %d", bootID, want)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if bootID, err := NextBootID(path, 300); err == nil {
+		t.Errorf("got boot ID %d from a corrupted file, want an error", bootID)
+	}
+}
@@ -0,0 +1,246 @@
+package exoip
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Kinds of health checks
+const (
+	CheckExec    = "exec"
+	CheckTCP     = "tcp"
+	CheckHTTP    = "http"
+	CheckProcess = "process"
+)
+
+// CheckConfig describes a health check
+type CheckConfig struct {
+	Kind     string
+	Target   string
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+	Weight   int
+	// Status is the HTTP status expected, any 2xx or 3xx when zero
+	Status int
+	// Args is the command run by an exec check, split from the target
+	Args []string
+}
+
+// ParseCheckConfig parses a check definition of the form KIND TARGET [OPTION=VALUE...]
+//
+// The kinds are exec (TARGET is an executable and its arguments), tcp
+// (host:port), http (an URL) and process (a process name). The options are
+// interval, timeout, rise, fall, weight and, for http, status. The target
+// may be quoted, e.g. to give arguments to the executable.
+func ParseCheckConfig(definition string) (CheckConfig, error) {
+	config := CheckConfig{
+		Interval: 2 * time.Second,
+		Rise:     2,
+		Fall:     3,
+	}
+
+	fields, err := splitFields(definition)
+	if err != nil {
+		return config, fmt.Errorf("check %q: %s", definition, err)
+	}
+	if len(fields) < 2 {
+		return config, fmt.Errorf("check %q: missing kind or target (KIND TARGET [OPTION=VALUE...])", definition)
+	}
+
+	config.Kind, config.Target = fields[0], fields[1]
+	switch config.Kind {
+	case CheckExec:
+		// the arguments are split like the definition, no shell is involved
+		config.Args, err = splitFields(config.Target)
+		if err != nil || len(config.Args) == 0 {
+			return config, fmt.Errorf("check %q: invalid command %q", definition, config.Target)
+		}
+	case CheckTCP, CheckHTTP, CheckProcess:
+	default:
+		return config, fmt.Errorf("check %q: unknown kind %q (exec, tcp, http or process)", definition, config.Kind)
+	}
+
+	for _, option := range fields[2:] {
+		i := strings.IndexRune(option, '=')
+		if i < 0 {
+			return config, fmt.Errorf("check %q: invalid option %q (OPTION=VALUE)", definition, option)
+		}
+
+		key, value := option[:i], option[i+1:]
+		switch key {
+		case "interval":
+			config.Interval, err = time.ParseDuration(value)
+		case "timeout":
+			config.Timeout, err = time.ParseDuration(value)
+		case "rise":
+			config.Rise, err = strconv.Atoi(value)
+		case "fall":
+			config.Fall, err = strconv.Atoi(value)
+		case "weight":
+			config.Weight, err = strconv.Atoi(value)
+		case "status":
+			config.Status, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+
+		if err != nil {
+			return config, fmt.Errorf("check %q: invalid option %q: %s", definition, option, err)
+		}
+	}
+
+	if config.Interval <= 0 || config.Timeout < 0 {
+		return config, fmt.Errorf("check %q: interval and timeout must be positive", definition)
+	}
+	if config.Timeout == 0 || config.Timeout > config.Interval {
+		config.Timeout = config.Interval
+	}
+	if config.Rise < 1 || config.Fall < 1 {
+		return config, fmt.Errorf("check %q: rise and fall must be at least 1", definition)
+	}
+	if config.Weight < 0 || config.Weight > 255 {
+		return config, fmt.Errorf("check %q: invalid weight (must be 0-255)", definition)
+	}
+
+	return config, nil
+}
+
+// String returns the short description of the check, e.g. tcp 127.0.0.1:80
+func (config CheckConfig) String() string {
+	return fmt.Sprintf("%s %s", config.Kind, config.Target)
+}
+
+// StartCheck runs the health check in the background every interval
+func (engine *Engine) StartCheck(config CheckConfig) {
+	tracker := engine.NewTracker(fmt.Sprintf("check %q", config), config.Rise, config.Fall, config.Weight)
+
+	go func() {
+		for {
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+			err := config.probe(ctx)
+			cancel()
+
+			if err != nil {
+				tracker.Report(false, err.Error())
+			} else {
+				tracker.Report(true, "")
+			}
+
+			time.Sleep(config.Interval - time.Since(start))
+		}
+	}()
+}
+
+// probe runs the check once
+func (config CheckConfig) probe(ctx context.Context) error {
+	switch config.Kind {
+	case CheckExec:
+		return exec.CommandContext(ctx, config.Args[0], config.Args[1:]...).Run()
+	case CheckTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", config.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case CheckHTTP:
+		return config.probeHTTP(ctx)
+	case CheckProcess:
+		return probeProcess(config.Target)
+	}
+	return fmt.Errorf("unknown kind %q", config.Kind)
+}
+
+// probeHTTP checks the status code of the URL
+func (config CheckConfig) probeHTTP(ctx context.Context) error {
+	req, err := http.NewRequest("GET", config.Target, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if config.Status != 0 && resp.StatusCode != config.Status {
+		return fmt.Errorf("got status %d, expected %d", resp.StatusCode, config.Status)
+	}
+	if config.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeProcess looks for a running process of the given name
+func probeProcess(name string) error {
+	comms, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return err
+	}
+
+	for _, comm := range comms {
+		content, err := ioutil.ReadFile(comm)
+		if err != nil {
+			// the process is gone
+			continue
+		}
+		if strings.TrimSpace(string(content)) == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no process named %q", name)
+}
+
+// splitFields splits the string around the spaces, except within quotes
+//
+// A field is quoted using single or double quotes, there are no escapes.
+func splitFields(s string) ([]string, error) {
+	fields := make([]string, 0)
+
+	var field strings.Builder
+	var quote rune
+	inField := false
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			field.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inField = true
+		case unicode.IsSpace(r):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
@@ -0,0 +1,99 @@
+package exoip
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCheckConfig(t *testing.T) {
+	tests := []struct {
+		definition string
+		config     CheckConfig
+	}{
+		{"tcp 127.0.0.1:80", CheckConfig{
+			Kind: CheckTCP, Target: "127.0.0.1:80",
+			Interval: 2 * time.Second, Timeout: 2 * time.Second, Rise: 2, Fall: 3,
+		}},
+		{"http http://localhost/health status=204 interval=5s timeout=1s weight=50", CheckConfig{
+			Kind: CheckHTTP, Target: "http://localhost/health",
+			Interval: 5 * time.Second, Timeout: time.Second, Rise: 2, Fall: 3, Weight: 50, Status: 204,
+		}},
+		{"exec /usr/local/bin/check timeout=10s rise=1 fall=1", CheckConfig{
+			Kind: CheckExec, Target: "/usr/local/bin/check",
+			Interval: 2 * time.Second, Timeout: 2 * time.Second, Rise: 1, Fall: 1,
+			Args: []string{"/usr/local/bin/check"},
+		}},
+		{`exec '/usr/local/bin/check --port 80 "a b"' interval=5s`, CheckConfig{
+			Kind: CheckExec, Target: `/usr/local/bin/check --port 80 "a b"`,
+			Interval: 5 * time.Second, Timeout: 5 * time.Second, Rise: 2, Fall: 3,
+			Args: []string{"/usr/local/bin/check", "--port", "80", "a b"},
+		}},
+		{"process haproxy", CheckConfig{
+			Kind: CheckProcess, Target: "haproxy",
+			Interval: 2 * time.Second, Timeout: 2 * time.Second, Rise: 2, Fall: 3,
+		}},
+	}
+
+	for _, tt := range tests {
+		config, err := ParseCheckConfig(tt.definition)
+		if err != nil {
+			t.Errorf("%s: %s", tt.definition, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, tt.config) {
+			t.Errorf("%s: got %+v, want %+v", tt.definition, config, tt.config)
+		}
+	}
+}
+
+func TestParseCheckConfigErrors(t *testing.T) {
+	for _, definition := range []string{
+		"",
+		"tcp",
+		"udp 127.0.0.1:53",
+		"exec '/usr/local/bin/check --port 80",
+		"exec '' interval=5s",
+		"tcp 127.0.0.1:80 interval",
+		"tcp 127.0.0.1:80 color=blue",
+		"tcp 127.0.0.1:80 interval=soon",
+		"tcp 127.0.0.1:80 interval=0s",
+		"tcp 127.0.0.1:80 timeout=-1s",
+		"tcp 127.0.0.1:80 rise=0",
+		"tcp 127.0.0.1:80 fall=0",
+		"tcp 127.0.0.1:80 weight=-1",
+		"tcp 127.0.0.1:80 weight=256",
+	} {
+		if config, err := ParseCheckConfig(definition); err == nil {
+			t.Errorf("%q: got %+v, want an error", definition, config)
+		}
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	tests := []struct {
+		s      string
+		fields []string
+	}{
+		{"", []string{}},
+		{"  a  b\tc ", []string{"a", "b", "c"}},
+		{`a "b c" 'd "e"'`, []string{"a", "b c", `d "e"`}},
+		{`a'b c'd`, []string{"ab cd"}},
+		{`a ""`, []string{"a", ""}},
+	}
+
+	for _, tt := range tests {
+		fields, err := splitFields(tt.s)
+		if err != nil {
+			t.Errorf("%q: %s", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%q: got %q, want %q", tt.s, fields, tt.fields)
+		}
+	}
+
+	if fields, err := splitFields(`a "b`); err == nil {
+		t.Errorf("got %q from an unterminated quote, want an error", fields)
+	}
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,10 +29,11 @@ const defaultPort = 12345
 
 type stringslice []string
 
-var timer = flag.Int("t", 1, "Advertisement interval in seconds")
+var timer = duration(time.Second)
 var prio = flag.Int("P", 10, "Host priority (lowest wins)")
 var address = flag.String("l", fmt.Sprintf(":%d", defaultPort), "Address to bind to")
 var deadRatio = flag.Int("r", 3, "Dead ratio")
+var deadTime duration
 var exoToken = flag.String("xk", "", "Exoscale API Key")
 var exoSecret = flag.String("xs", "", "Exoscale API Secret")
 var csEndpoint = flag.String("xe", "https://api.exoscale.ch/compute", "Exoscale API Endpoint")
@@ -40,10 +45,45 @@ var validateConfig = flag.Bool("n", false, "Validate configuration and exit")
 var watchMode = flag.Bool("W", false, "Watchdog mode")
 var associateMode = flag.Bool("A", false, "Associate EIP and exit")
 var disassociateMode = flag.Bool("D", false, "Dissociate EIP and exit")
+var monitorMode = flag.Bool("M", false, "Monitor mode, report the state of the groups without taking part")
 var logStdout = flag.Bool("O", false, "Do not log to syslog, use standard output")
 var printVersion = flag.Bool("version", false, "Print version and quit")
+var authKey = flag.String("auth-key", "", "Shared key used to authenticate the advertisements")
+var authKeyFile = flag.String("auth-key-file", "", "File containing the shared key used to authenticate the advertisements")
+var bootIDFile = flag.String("boot-id-file", "", "File recording the last boot ID, so that it grows even if the clock goes back")
+var noPreempt = flag.Bool("nopreempt", false, "Let the current master keep the EIP until it fails")
+var preemptDelay duration
+var minMasterTime duration
+var flapPenalty = flag.Int("flap-penalty", 0, "Priority penalty added every time we become master again, 0 to disable")
+var flapHalfLife = duration(exoip.DefaultFlapHalfLife)
+var quarantineFlaps = flag.Int("quarantine-flaps", 0, "Quarantine the peers coming back to life that many times, 0 to disable")
+var quarantineTime = duration(exoip.DefaultQuarantineTime)
+var fencePolicy = flag.String("fence", "none", "What to do to the dead peers besides releasing the EIP: none, isolate, stop or reboot")
+var fenceInterval = duration(exoip.DefaultFenceInterval)
+var reconcileInterval = duration(time.Minute)
+var leaseDuration duration
+var apiRetries = flag.Int("api-retries", exoip.DefaultAPIAttempts, "Number of attempts of an API call failing transiently")
+var apiTimeout = duration(exoip.DefaultAPITimeout)
+var apiBreaker = flag.Int("api-breaker", exoip.DefaultAPIBreaker, "Enter the fault state after that many API failures in a row, 0 to disable")
+var witness = flag.Bool("witness", false, "Take part in the heartbeats and votes but never hold the EIP")
+var quorum = flag.Bool("quorum", false, "Wait for a majority of the peers to agree that a peer is dead before acting")
+var notifyAny = flag.String("notify", "", "Script to run on every state transition")
+var notifyMaster = flag.String("notify-master", "", "Script to run when becoming master")
+var notifyBackup = flag.String("notify-backup", "", "Script to run when becoming backup")
+var notifyFault = flag.String("notify-fault", "", "Script to run when entering the fault state")
+var notifyPolicy = flag.String("notify-policy", "async", "How the notify scripts affect the transitions: async, block or abort")
+var notifyTimeout = duration(exoip.DefaultNotifyTimeout)
 var peers stringslice
 var resetPeers = false
+var groups groupslice
+var resetGroups = false
+var checks checkslice
+var resetChecks = false
+var interfaces interfaceslice
+var resetInterfaces = false
+var isolationCheck = flag.Bool("isolation-check", false, "Check that the default gateway or the references are reachable before taking over")
+var references referenceslice
+var resetReferences = false
 
 func (s *stringslice) String() string {
 	return strings.Join(*s, ",")
@@ -61,6 +101,100 @@ func (s *stringslice) Set(value string) error { // nolint: unparam
 	return nil
 }
 
+// duration is a time.Duration flag which also accepts a number of seconds
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(value string) error {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		*d = duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*d = duration(v)
+	return nil
+}
+
+type groupslice []string
+
+func (s *groupslice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *groupslice) Set(value string) error { // nolint: unparam
+	if resetGroups {
+		*s = make([]string, 0)
+	}
+	resetGroups = false
+	groups := strings.Split(value, ",")
+	for _, group := range groups {
+		*s = append(*s, group)
+	}
+	return nil
+}
+
+type interfaceslice []string
+
+func (s *interfaceslice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *interfaceslice) Set(value string) error { // nolint: unparam
+	if resetInterfaces {
+		*s = make([]string, 0)
+	}
+	resetInterfaces = false
+	interfaces := strings.Split(value, ",")
+	for _, iface := range interfaces {
+		*s = append(*s, iface)
+	}
+	return nil
+}
+
+type referenceslice []string
+
+func (s *referenceslice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *referenceslice) Set(value string) error { // nolint: unparam
+	if resetReferences {
+		*s = make([]string, 0)
+	}
+	resetReferences = false
+	references := strings.Split(value, ",")
+	for _, reference := range references {
+		*s = append(*s, reference)
+	}
+	return nil
+}
+
+type checkslice []string
+
+func (s *checkslice) String() string {
+	return strings.Join(*s, ";")
+}
+
+func (s *checkslice) Set(value string) error { // nolint: unparam
+	if resetChecks {
+		*s = make([]string, 0)
+	}
+	resetChecks = false
+	// the definitions contain spaces and may contain commas
+	checks := strings.Split(value, ";")
+	for _, check := range checks {
+		*s = append(*s, strings.TrimSpace(check))
+	}
+	return nil
+}
+
 type envEquiv struct {
 	Env  string
 	Flag string
@@ -75,6 +209,7 @@ func parseEnvironment() {
 		envEquiv{Env: "IF_BIND_TO", Flag: "l"},
 		envEquiv{Env: "IF_DEAD_RATIO", Flag: "r"},
 		envEquiv{Env: "IF_ADVERTISEMENT_INTERVAL", Flag: "t"},
+		envEquiv{Env: "IF_DEAD_TIME", Flag: "T"},
 		envEquiv{Env: "IF_HOST_PRIORITY", Flag: "P"},
 		envEquiv{Env: "IF_EXOSCALE_API_KEY", Flag: "xk"},
 		envEquiv{Env: "IF_EXOSCALE_API_SECRET", Flag: "xs"},
@@ -82,6 +217,36 @@ func parseEnvironment() {
 		envEquiv{Env: "IF_EXOSCALE_PEER_GROUP", Flag: "G"},
 		envEquiv{Env: "IF_EXOSCALE_INSTANCE_ID", Flag: "i"},
 		envEquiv{Env: "IF_EXOSCALE_PEERS", Flag: "p"},
+		envEquiv{Env: "IF_EXOSCALE_GROUPS", Flag: "g"},
+		envEquiv{Env: "IF_AUTH_KEY", Flag: "auth-key"},
+		envEquiv{Env: "IF_AUTH_KEY_FILE", Flag: "auth-key-file"},
+		envEquiv{Env: "IF_BOOT_ID_FILE", Flag: "boot-id-file"},
+		envEquiv{Env: "IF_NO_PREEMPT", Flag: "nopreempt"},
+		envEquiv{Env: "IF_PREEMPT_DELAY", Flag: "preempt-delay"},
+		envEquiv{Env: "IF_MIN_MASTER_TIME", Flag: "min-master-time"},
+		envEquiv{Env: "IF_FLAP_PENALTY", Flag: "flap-penalty"},
+		envEquiv{Env: "IF_FLAP_HALF_LIFE", Flag: "flap-half-life"},
+		envEquiv{Env: "IF_QUARANTINE_FLAPS", Flag: "quarantine-flaps"},
+		envEquiv{Env: "IF_QUARANTINE_TIME", Flag: "quarantine-time"},
+		envEquiv{Env: "IF_FENCE", Flag: "fence"},
+		envEquiv{Env: "IF_FENCE_INTERVAL", Flag: "fence-interval"},
+		envEquiv{Env: "IF_RECONCILE_INTERVAL", Flag: "reconcile-interval"},
+		envEquiv{Env: "IF_LEASE", Flag: "lease"},
+		envEquiv{Env: "IF_API_RETRIES", Flag: "api-retries"},
+		envEquiv{Env: "IF_API_TIMEOUT", Flag: "api-timeout"},
+		envEquiv{Env: "IF_API_BREAKER", Flag: "api-breaker"},
+		envEquiv{Env: "IF_QUORUM", Flag: "quorum"},
+		envEquiv{Env: "IF_WITNESS", Flag: "witness"},
+		envEquiv{Env: "IF_HEALTH_CHECKS", Flag: "check"},
+		envEquiv{Env: "IF_TRACK_INTERFACES", Flag: "track-interface"},
+		envEquiv{Env: "IF_ISOLATION_CHECK", Flag: "isolation-check"},
+		envEquiv{Env: "IF_REFERENCES", Flag: "reference"},
+		envEquiv{Env: "IF_NOTIFY", Flag: "notify"},
+		envEquiv{Env: "IF_NOTIFY_MASTER", Flag: "notify-master"},
+		envEquiv{Env: "IF_NOTIFY_BACKUP", Flag: "notify-backup"},
+		envEquiv{Env: "IF_NOTIFY_FAULT", Flag: "notify-fault"},
+		envEquiv{Env: "IF_NOTIFY_POLICY", Flag: "notify-policy"},
+		envEquiv{Env: "IF_NOTIFY_TIMEOUT", Flag: "notify-timeout"},
 	}
 
 	for _, env := range envFlags {
@@ -94,6 +259,10 @@ func parseEnvironment() {
 	}
 
 	resetPeers = true
+	resetGroups = true
+	resetChecks = true
+	resetInterfaces = true
+	resetReferences = true
 }
 
 func setupLogger() {
@@ -105,12 +274,15 @@ func setupLogger() {
 }
 
 func checkConfiguration() {
-	die := !checkMode() || !checkEIP() || !checkInstanceID()
+	die := !checkMode() || !checkEIP() || !checkInstanceID() || !checkNotify()
 	if *watchMode {
-		die = die || !checkPeerAndSecurityGroups() || !checkPeerDefinition() || !checkHostPriority()
+		die = die || !checkPeerAndSecurityGroups() || !checkPeerDefinition() || !checkHostPriority() || !checkAuthKey() || !checkTimers() || !checkPreemptDelay() || !checkDamping() || !checkFence() || !checkReconcileInterval() || !checkLease() || !checkHealthChecks() || !checkInterfaces()
+	}
+	if *monitorMode {
+		die = die || !checkAuthKey() || !checkTimers()
 	}
 
-	die = die || !checkAPI()
+	die = die || !checkAPI() || !checkRetry()
 
 	if die {
 		os.Exit(1)
@@ -128,12 +300,15 @@ func checkMode() bool {
 	if *disassociateMode {
 		i++
 	}
+	if *monitorMode {
+		i++
+	}
 
 	if i != 1 {
-		if _, err := fmt.Fprintln(os.Stderr, "need exactly one of -A, -D, or -W"); err != nil {
+		if _, err := fmt.Fprintln(os.Stderr, "need exactly one of -A, -D, -M, or -W"); err != nil {
 			panic(err)
 		}
-		exoip.Logger.Info("invalid mode: need exactly one of -A, -D, or -W")
+		exoip.Logger.Info("invalid mode: need exactly one of -A, -D, -M, or -W")
 		return false
 	}
 
@@ -152,16 +327,65 @@ func checkInstanceID() bool {
 }
 
 func checkEIP() bool {
-	if len(*eip) == 0 {
+	if len(*eip) > 0 && len(groups) > 0 {
+		exoip.Logger.Crit("ambiguous Exoscale IP definition (-xi and -g given)")
+		if _, err := fmt.Fprintln(os.Stderr, "-xi and -g options are exclusive"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	if len(*eip) == 0 && len(groups) == 0 {
 		exoip.Logger.Crit("no Exoscale IP provided")
 		if _, err := fmt.Fprintln(os.Stderr, "no Exoscale IP provided"); err != nil {
 			panic(err)
 		}
 		return false
 	}
+
+	if _, err := groupConfigs(); err != nil {
+		exoip.Logger.Crit("%s", err)
+		if _, err := fmt.Fprintln(os.Stderr, err); err != nil {
+			panic(err)
+		}
+		return false
+	}
 	return true
 }
 
+// groupConfigs returns the groups defined by -g, or the one defined by -xi
+func groupConfigs() ([]exoip.GroupConfig, error) {
+	if len(groups) == 0 {
+		ip := net.ParseIP(*eip)
+		if ip == nil {
+			return nil, fmt.Errorf("not a valid IP Address")
+		}
+
+		return []exoip.GroupConfig{{
+			ID:           exoip.DefaultGroupID,
+			ElasticIP:    ip,
+			Priority:     *prio,
+			NoPreempt:    *noPreempt,
+			PreemptDelay: time.Duration(preemptDelay),
+			Quorum:       *quorum,
+		}}, nil
+	}
+
+	configs := make([]exoip.GroupConfig, 0, len(groups))
+	for _, definition := range groups {
+		config, err := exoip.ParseGroupConfig(definition, *prio)
+		if err != nil {
+			return nil, err
+		}
+		config.NoPreempt = *noPreempt
+		config.PreemptDelay = time.Duration(preemptDelay)
+		config.Quorum = *quorum
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
 func checkPeerAndSecurityGroups() bool {
 	if len(peers) > 0 && len(*exoSecurityGroup) > 0 {
 		exoip.Logger.Crit("ambiguous peer definition (-p and -G given)")
@@ -196,6 +420,251 @@ func checkHostPriority() bool {
 	return true
 }
 
+func checkAuthKey() bool {
+	if len(*authKey) > 0 && len(*authKeyFile) > 0 {
+		exoip.Logger.Crit("ambiguous key definition (-auth-key and -auth-key-file given)")
+		if _, err := fmt.Fprintln(os.Stderr, "-auth-key and -auth-key-file options are exclusive"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	if len(*authKeyFile) > 0 {
+		if _, err := exoip.ReadAuthKey(*authKeyFile); err != nil {
+			exoip.Logger.Crit("cannot read key file: %s", err)
+			if _, err := fmt.Fprintf(os.Stderr, "cannot read key file: %s\n", err); err != nil {
+				panic(err)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// deadDuration returns the dead time, defined by -T or by -r times -t
+func deadDuration() time.Duration {
+	if deadTime > 0 {
+		return time.Duration(deadTime)
+	}
+	return time.Duration(*deadRatio) * time.Duration(timer)
+}
+
+func checkTimers() bool {
+	if time.Duration(timer) < exoip.MinInterval {
+		exoip.Logger.Crit("invalid advertisement interval (must be at least %s)", exoip.MinInterval)
+		if _, err := fmt.Fprintf(os.Stderr, "invalid advertisement interval (must be at least %s)\n", exoip.MinInterval); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	if deadDuration() <= time.Duration(timer) {
+		exoip.Logger.Crit("invalid dead time (must be longer than the advertisement interval)")
+		if _, err := fmt.Fprintln(os.Stderr, "invalid dead time (must be longer than the advertisement interval)"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func checkPreemptDelay() bool {
+	if preemptDelay < 0 {
+		exoip.Logger.Crit("invalid preempt delay (must be positive)")
+		if _, err := fmt.Fprintln(os.Stderr, "invalid preempt delay (must be positive)"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func checkDamping() bool {
+	msg := ""
+	switch {
+	case minMasterTime < 0:
+		msg = "invalid minimum master time (must be positive)"
+	case *flapPenalty < 0 || *flapPenalty > 255:
+		msg = "invalid flap penalty (must be 0-255)"
+	case flapHalfLife <= 0:
+		msg = "invalid flap half-life (must be positive)"
+	case *quarantineFlaps < 0:
+		msg = "invalid number of quarantine flaps (must be positive)"
+	case quarantineTime <= 0:
+		msg = "invalid quarantine time (must be positive)"
+	}
+
+	if msg != "" {
+		exoip.Logger.Crit("%s", msg)
+		if _, err := fmt.Fprintln(os.Stderr, msg); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func checkFence() bool {
+	if _, err := exoip.ParseFencePolicy(*fencePolicy); err != nil {
+		exoip.Logger.Crit("%s", err)
+		if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
+			panic(errP)
+		}
+		return false
+	}
+
+	if fenceInterval <= 0 {
+		exoip.Logger.Crit("invalid fence interval (must be positive)")
+		if _, err := fmt.Fprintln(os.Stderr, "invalid fence interval (must be positive)"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func checkLease() bool {
+	if leaseDuration < 0 || (leaseDuration > 0 && leaseDuration < 10*duration(time.Second)) {
+		exoip.Logger.Crit("invalid lease duration (must be 0 or at least 10s)")
+		if _, err := fmt.Fprintln(os.Stderr, "invalid lease duration (must be 0 or at least 10s)"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func checkReconcileInterval() bool {
+	if reconcileInterval < 0 {
+		exoip.Logger.Crit("invalid reconcile interval (must be positive)")
+		if _, err := fmt.Fprintln(os.Stderr, "invalid reconcile interval (must be positive)"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func checkHealthChecks() bool {
+	if _, err := checkConfigs(); err != nil {
+		exoip.Logger.Crit("%s", err)
+		if _, err := fmt.Fprintln(os.Stderr, err); err != nil {
+			panic(err)
+		}
+		return false
+	}
+	return true
+}
+
+// checkConfigs returns the health checks defined by -check
+func checkConfigs() ([]exoip.CheckConfig, error) {
+	configs := make([]exoip.CheckConfig, 0, len(checks))
+	for _, definition := range checks {
+		config, err := exoip.ParseCheckConfig(definition)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func checkInterfaces() bool {
+	if _, err := interfaceConfigs(); err != nil {
+		exoip.Logger.Crit("%s", err)
+		if _, err := fmt.Fprintln(os.Stderr, err); err != nil {
+			panic(err)
+		}
+		return false
+	}
+	return true
+}
+
+// interfaceConfigs returns the interfaces defined by -track-interface
+func interfaceConfigs() ([]exoip.InterfaceConfig, error) {
+	configs := make([]exoip.InterfaceConfig, 0, len(interfaces))
+	for _, definition := range interfaces {
+		config, err := exoip.ParseInterfaceConfig(definition)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func checkNotify() bool {
+	if _, err := exoip.ParseNotifyPolicy(*notifyPolicy); err != nil {
+		exoip.Logger.Crit("%s", err)
+		if _, err := fmt.Fprintln(os.Stderr, err); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	if notifyTimeout <= 0 {
+		exoip.Logger.Crit("invalid notify timeout (must be positive)")
+		if _, err := fmt.Fprintln(os.Stderr, "invalid notify timeout (must be positive)"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	for _, script := range []string{*notifyAny, *notifyMaster, *notifyBackup, *notifyFault} {
+		if script == "" {
+			continue
+		}
+		if _, err := exec.LookPath(script); err != nil {
+			exoip.Logger.Crit("invalid notify script: %s", err)
+			if _, err := fmt.Fprintf(os.Stderr, "invalid notify script: %s\n", err); err != nil {
+				panic(err)
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// dampingConfig returns the flap damping configuration
+func dampingConfig() exoip.DampingConfig {
+	return exoip.DampingConfig{
+		MinMasterTime:   time.Duration(minMasterTime),
+		Penalty:         *flapPenalty,
+		HalfLife:        time.Duration(flapHalfLife),
+		QuarantineFlaps: *quarantineFlaps,
+		QuarantineTime:  time.Duration(quarantineTime),
+	}
+}
+
+// fenceConfig returns the fencing configuration
+func fenceConfig() exoip.FenceConfig {
+	policy, _ := exoip.ParseFencePolicy(*fencePolicy) // nolint: errcheck
+	return exoip.FenceConfig{
+		Policy:   policy,
+		Interval: time.Duration(fenceInterval),
+	}
+}
+
+// notifyConfig returns the notify scripts configuration
+func notifyConfig() exoip.NotifyConfig {
+	policy, _ := exoip.ParseNotifyPolicy(*notifyPolicy) // nolint: errcheck
+	return exoip.NotifyConfig{
+		Master:  *notifyMaster,
+		Backup:  *notifyBackup,
+		Fault:   *notifyFault,
+		Any:     *notifyAny,
+		Timeout: time.Duration(notifyTimeout),
+		Policy:  policy,
+	}
+}
+
 func checkAPI() bool {
 	if len(*exoToken) == 0 || len(*csEndpoint) == 0 || len(*exoSecret) == 0 {
 		exoip.Logger.Crit("insufficient API credentials")
@@ -207,15 +676,72 @@ func checkAPI() bool {
 	return true
 }
 
+func checkRetry() bool {
+	if *apiRetries < 1 || apiTimeout <= 0 || *apiBreaker < 0 {
+		exoip.Logger.Crit("invalid API settings (-api-retries must be at least 1, -api-timeout positive and -api-breaker not negative)")
+		if _, err := fmt.Fprintln(os.Stderr, "invalid API settings (-api-retries must be at least 1, -api-timeout positive and -api-breaker not negative)"); err != nil {
+			panic(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func retryConfig() exoip.RetryConfig {
+	return exoip.RetryConfig{
+		Attempts: *apiRetries,
+		Timeout:  time.Duration(apiTimeout),
+		Breaker:  *apiBreaker,
+	}
+}
+
 func printConfiguration() {
+	configs, _ := groupConfigs() // nolint: errcheck
+	ips := make([]string, len(configs))
+	for i, config := range configs {
+		ips[i] = config.ElasticIP.String()
+	}
+	eips := strings.Join(ips, ", ")
+
 	if *watchMode {
-		fmt.Printf("exoip will watch over: %s\n", *eip)
+		fmt.Printf("exoip will watch over: %s\n", eips)
 		fmt.Printf("\tbind-address: %s\n", *address)
-		fmt.Printf("\thost-priority: %d\n", *prio)
-		fmt.Printf("\tadvertisement-interval: %d\n", *timer)
-		fmt.Printf("\tdead-ratio: %d\n", *deadRatio)
+		for _, config := range configs {
+			fmt.Printf("\tgroup %d: %s (host-priority: %d)\n", config.ID, config.ElasticIP, config.Priority)
+		}
+		for _, check := range checks {
+			fmt.Printf("\tcheck: %s\n", check)
+		}
+		for _, iface := range interfaces {
+			fmt.Printf("\ttrack-interface: %s\n", iface)
+		}
+		fmt.Printf("\tisolation-check: %v\n", *isolationCheck || len(references) > 0)
+		for _, reference := range references {
+			fmt.Printf("\treference: %s\n", reference)
+		}
+		fmt.Printf("\tadvertisement-interval: %s\n", timer.String())
+		fmt.Printf("\tdead-time: %s\n", deadDuration())
+		fmt.Printf("\tauthentication: %v\n", len(*authKey) > 0 || len(*authKeyFile) > 0)
+		fmt.Printf("\tboot-id-file: %s\n", *bootIDFile)
+		fmt.Printf("\tpreempt: %v\n", !*noPreempt)
+		fmt.Printf("\tpreempt-delay: %s\n", preemptDelay.String())
+		fmt.Printf("\tmin-master-time: %s\n", minMasterTime.String())
+		fmt.Printf("\tflap-penalty: %d (half-life: %s)\n", *flapPenalty, flapHalfLife.String())
+		fmt.Printf("\tquarantine-flaps: %d (quarantine-time: %s)\n", *quarantineFlaps, quarantineTime.String())
+		fmt.Printf("\tfence: %s (interval: %s)\n", *fencePolicy, fenceInterval.String())
+		fmt.Printf("\treconcile-interval: %s\n", reconcileInterval.String())
+		fmt.Printf("\tlease: %s\n", leaseDuration.String())
+		fmt.Printf("\tapi-retries: %d (timeout: %s, breaker: %d)\n", *apiRetries, apiTimeout.String(), *apiBreaker)
+		fmt.Printf("\tquorum: %v\n", *quorum)
+		fmt.Printf("\twitness: %v\n", *witness)
+	} else if *monitorMode {
+		fmt.Printf("exoip will monitor: %s\n", eips)
+		fmt.Printf("\tbind-address: %s\n", *address)
+		fmt.Printf("\tdead-time: %s\n", deadDuration())
+		fmt.Printf("\tauthentication: %v\n", len(*authKey) > 0 || len(*authKeyFile) > 0)
 	} else {
-		fmt.Printf("exoip manages: %s\n", *eip)
+		fmt.Printf("exoip manages: %s\n", eips)
 	}
 	fmt.Printf("\tinstance-id: %s\n", *instanceID)
 	fmt.Printf("\texoscale-api-key: %s\n", *exoToken)
@@ -223,13 +749,43 @@ func printConfiguration() {
 	fmt.Printf("\texoscale-api-endpoint: %s\n", *csEndpoint)
 
 	if *watchMode {
-		exoip.Logger.Info("exoip will watch over: %s\n", *eip)
+		exoip.Logger.Info("exoip will watch over: %s\n", eips)
 		exoip.Logger.Info("\tbind-address: %s\n", *address)
-		exoip.Logger.Info("\thost-priority: %d\n", *prio)
-		exoip.Logger.Info("\tadvertisement-interval: %d\n", *timer)
-		exoip.Logger.Info("\tdead-ratio: %d\n", *deadRatio)
+		for _, config := range configs {
+			exoip.Logger.Info("\tgroup %d: %s (host-priority: %d)\n", config.ID, config.ElasticIP, config.Priority)
+		}
+		for _, check := range checks {
+			exoip.Logger.Info("\tcheck: %s\n", check)
+		}
+		for _, iface := range interfaces {
+			exoip.Logger.Info("\ttrack-interface: %s\n", iface)
+		}
+		exoip.Logger.Info("\tisolation-check: %v\n", *isolationCheck || len(references) > 0)
+		for _, reference := range references {
+			exoip.Logger.Info("\treference: %s\n", reference)
+		}
+		exoip.Logger.Info("\tadvertisement-interval: %s\n", timer.String())
+		exoip.Logger.Info("\tdead-time: %s\n", deadDuration())
+		exoip.Logger.Info("\tauthentication: %v\n", len(*authKey) > 0 || len(*authKeyFile) > 0)
+		exoip.Logger.Info("\tboot-id-file: %s\n", *bootIDFile)
+		exoip.Logger.Info("\tpreempt: %v\n", !*noPreempt)
+		exoip.Logger.Info("\tpreempt-delay: %s\n", preemptDelay.String())
+		exoip.Logger.Info("\tmin-master-time: %s\n", minMasterTime.String())
+		exoip.Logger.Info("\tflap-penalty: %d (half-life: %s)\n", *flapPenalty, flapHalfLife.String())
+		exoip.Logger.Info("\tquarantine-flaps: %d (quarantine-time: %s)\n", *quarantineFlaps, quarantineTime.String())
+		exoip.Logger.Info("\tfence: %s (interval: %s)\n", *fencePolicy, fenceInterval.String())
+		exoip.Logger.Info("\treconcile-interval: %s\n", reconcileInterval.String())
+		exoip.Logger.Info("\tlease: %s\n", leaseDuration.String())
+		exoip.Logger.Info("\tapi-retries: %d (timeout: %s, breaker: %d)\n", *apiRetries, apiTimeout.String(), *apiBreaker)
+		exoip.Logger.Info("\tquorum: %v\n", *quorum)
+		exoip.Logger.Info("\twitness: %v\n", *witness)
+	} else if *monitorMode {
+		exoip.Logger.Info("exoip will monitor: %s\n", eips)
+		exoip.Logger.Info("\tbind-address: %s\n", *address)
+		exoip.Logger.Info("\tdead-time: %s\n", deadDuration())
+		exoip.Logger.Info("\tauthentication: %v\n", len(*authKey) > 0 || len(*authKeyFile) > 0)
 	} else {
-		exoip.Logger.Info("exoip manages: %s\n", *eip)
+		exoip.Logger.Info("exoip manages: %s\n", eips)
 	}
 	exoip.Logger.Info("\tinstance-id: %s\n", *instanceID)
 	exoip.Logger.Info("\texoscale-api-key: %s\n", *exoToken)
@@ -252,6 +808,21 @@ func main() {
 	var engine *exoip.Engine
 
 	flag.Var(&peers, "p", "peers to communicate with")
+	flag.Var(&groups, "g", "Groups to watch over (ID=EIP[@PRIORITY])")
+	flag.Var(&references, "reference", "Reference IP[:PORT] of the isolation check, instead of the default gateway")
+	flag.Var(&interfaces, "track-interface", "Network interfaces to track (NAME[@WEIGHT])")
+	flag.Var(&checks, "check", "Health check (KIND TARGET [interval=D] [timeout=D] [rise=N] [fall=N] [weight=N] [status=N])")
+	flag.Var(&timer, "t", "Advertisement interval (duration or seconds)")
+	flag.Var(&deadTime, "T", "Dead time (duration or seconds), overrides -r")
+	flag.Var(&notifyTimeout, "notify-timeout", "How long a notify script may run (duration or seconds)")
+	flag.Var(&preemptDelay, "preempt-delay", "How long a better peer must be alive before taking over (duration or seconds)")
+	flag.Var(&minMasterTime, "min-master-time", "How long a new master stays so before stepping down for a better peer (duration or seconds)")
+	flag.Var(&flapHalfLife, "flap-half-life", "How long it takes for the flap penalty to be halved (duration or seconds)")
+	flag.Var(&quarantineTime, "quarantine-time", "How long a flapping peer is quarantined (duration or seconds)")
+	flag.Var(&fenceInterval, "fence-interval", "Shortest time between two fencing actions (duration or seconds)")
+	flag.Var(&reconcileInterval, "reconcile-interval", "How often the NICs of the zone are scanned for the EIPs, 0 to disable (duration or seconds)")
+	flag.Var(&apiTimeout, "api-timeout", "Deadline of every attempt of an API call (duration or seconds)")
+	flag.Var(&leaseDuration, "lease", "Duration of the lease on the EIP recorded in its tags, 0 to disable (duration or seconds)")
 
 	parseEnvironment()
 	flag.Parse()
@@ -291,30 +862,43 @@ func main() {
 		os.Exit(0)
 	}
 
+	rand.Seed(time.Now().UnixNano())
+
 	ego := egoscale.NewClient(*csEndpoint, *exoToken, *exoSecret)
 
-	ip := net.ParseIP(*eip)
-	if ip == nil {
-		if _, errP := fmt.Fprintln(os.Stderr, "not a valid IP Address"); errP != nil {
+	configs, err := groupConfigs()
+	if err != nil {
+		if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
 			panic(errP)
 		}
 		os.Exit(1)
 	}
 
 	if *associateMode || *disassociateMode {
-		engine = exoip.NewEngine(ego, ip, *egoscale.MustParseUUID(*instanceID))
+		ips := make([]net.IP, len(configs))
+		for i, config := range configs {
+			ips[i] = config.ElasticIP
+		}
+		engine = exoip.NewEngine(ego, ips, *egoscale.MustParseUUID(*instanceID))
+		engine.Notify = notifyConfig()
+		engine.Retry = retryConfig()
+		engine.Retry.Breaker = 0
 
-		var state exoip.State
+		state, reason := exoip.StateBackup, "dissociation mode"
 		if *associateMode {
-			state = exoip.StateMaster
-		} else {
-			state = exoip.StateBackup
+			state, reason = exoip.StateMaster, "association mode"
 		}
 
-		if err := engine.PerformStateTransition(state); err != nil {
-			if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
-				panic(errP)
+		failed := false
+		for _, group := range engine.Groups() {
+			if err := group.PerformStateTransition(state, reason); err != nil {
+				if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
+					panic(errP)
+				}
+				failed = true
 			}
+		}
+		if failed {
 			os.Exit(1)
 		}
 		os.Exit(0)
@@ -338,7 +922,7 @@ func main() {
 					if err != nil {
 						continue
 					}
-					if ip != nil && ipAddress.To4() != nil {
+					if ipAddress.To4() != nil {
 						*address = fmt.Sprintf("%s%s", ipAddress.String(), *address)
 						exoip.Logger.Info("using IP address from %s", iface.Name)
 						break outterfor
@@ -348,6 +932,49 @@ func main() {
 		}
 	}
 
+	key := []byte(*authKey)
+	if len(*authKeyFile) > 0 {
+		var err error
+		key, err = exoip.ReadAuthKey(*authKeyFile)
+		if err != nil {
+			if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
+				panic(errP)
+			}
+			os.Exit(1)
+		}
+	}
+
+	if *monitorMode {
+		monitor := exoip.NewMonitor(ego, *address, configs, *egoscale.MustParseUUID(*instanceID), deadDuration(), key)
+
+		go func() {
+			// look at who holds the EIPs, every 30 seconds
+			interval := 30 * time.Second
+			for {
+				start := time.Now()
+				if err := monitor.PollHolders(); err != nil {
+					exoip.Logger.Crit("%s", err)
+				}
+				time.Sleep(interval - time.Since(start))
+			}
+		}()
+
+		go func() {
+			// look at the liveness of the peers, every interval
+			for {
+				start := time.Now()
+				monitor.CheckPeers()
+				time.Sleep(time.Duration(timer) - time.Since(start))
+			}
+		}()
+
+		exoip.Logger.Info("starting monitor")
+		if err := monitor.NetworkLoop(); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+
 	if len(*exoSecurityGroup) > 0 {
 		if len(peers) > 0 {
 			if _, err := fmt.Fprintln(os.Stderr, "-p and -G options are exclusive"); err != nil {
@@ -356,101 +983,179 @@ func main() {
 			os.Exit(1)
 		}
 
-		engine = exoip.NewEngineWatchdog(ego, *address, ip, *egoscale.MustParseUUID(*instanceID), *timer, *prio, *deadRatio, nil, *exoSecurityGroup)
+		engine = exoip.NewEngineWatchdog(ego, *address, configs, *egoscale.MustParseUUID(*instanceID), time.Duration(timer), deadDuration(), nil, *exoSecurityGroup, key)
 	} else {
-		engine = exoip.NewEngineWatchdog(ego, *address, ip, *egoscale.MustParseUUID(*instanceID), *timer, *prio, *deadRatio, peers, "")
+		engine = exoip.NewEngineWatchdog(ego, *address, configs, *egoscale.MustParseUUID(*instanceID), time.Duration(timer), deadDuration(), peers, "", key)
+	}
+
+	if len(*bootIDFile) > 0 {
+		bootID, err := exoip.NextBootID(*bootIDFile, engine.BootID)
+		if err != nil {
+			exoip.Logger.Crit("%s", err)
+			if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
+				panic(errP)
+			}
+			os.Exit(1)
+		}
+		engine.BootID = bootID
+	}
+
+	engine.Notify = notifyConfig()
+	engine.Damping = dampingConfig()
+	engine.Fence = fenceConfig()
+	engine.LeaseDuration = time.Duration(leaseDuration)
+	engine.Retry = retryConfig()
+	engine.Witness = *witness
+
+	healthChecks, _ := checkConfigs() // nolint: errcheck
+	for _, config := range healthChecks {
+		engine.StartCheck(config)
+	}
+
+	if *isolationCheck || len(references) > 0 {
+		if err := engine.StartIsolationCheck(references); err != nil {
+			exoip.Logger.Crit("%s", err)
+			if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
+				panic(errP)
+			}
+			os.Exit(1)
+		}
+	}
+
+	trackedInterfaces, _ := interfaceConfigs() // nolint: errcheck
+	for _, config := range trackedInterfaces {
+		if err := engine.TrackInterface(config); err != nil {
+			exoip.Logger.Crit("%s", err)
+			if _, errP := fmt.Fprintln(os.Stderr, err); errP != nil {
+				panic(errP)
+			}
+			os.Exit(1)
+		}
 	}
 
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGTERM)
 	signal.Notify(sigs, syscall.SIGINT)
 	signal.Notify(sigs, syscall.SIGUSR1)
 	signal.Notify(sigs, syscall.SIGUSR2)
 
-	stopping := false
+	// stopping is set by the signal handler and read by the loops
+	var stopping uint32
+	stopped := func() bool {
+		return atomic.LoadUint32(&stopping) != 0
+	}
 
 	go func() {
 		for {
 			sig := <-sigs
 			exoip.Logger.Info("got sig: %+v", sig)
 			if _, err := fmt.Fprintf(os.Stderr, "got sig: %+v\n", sig); err != nil {
-				exoip.Logger.Crit(err.Error())
+				exoip.Logger.Crit("%s", err)
 			}
 			switch sig {
 			case syscall.SIGUSR1:
-				prio, err := engine.LowerPriority()
-				if err != nil {
-					exoip.Logger.Warning(err.Error())
-				} else {
-					exoip.Logger.Info("new priority: %d", prio)
+				for _, group := range engine.Groups() {
+					prio, err := group.LowerPriority()
+					if err != nil {
+						exoip.Logger.Warning("group %d: %s", group.ID, err)
+					} else {
+						exoip.Logger.Info("group %d new priority: %d", group.ID, prio)
+					}
 				}
 			case syscall.SIGUSR2:
-				prio, err := engine.RaisePriority()
-				if err != nil {
-					exoip.Logger.Warning(err.Error())
-				} else {
-					exoip.Logger.Info("new priority: %d", prio)
+				for _, group := range engine.Groups() {
+					prio, err := group.RaisePriority()
+					if err != nil {
+						exoip.Logger.Warning("group %d: %s", group.ID, err)
+					} else {
+						exoip.Logger.Info("group %d new priority: %d", group.ID, prio)
+					}
 				}
 			default:
-				if engine.State == exoip.StateMaster {
-					stopping = true
+				atomic.StoreUint32(&stopping, 1)
+				if engine.IsMaster() {
 					exoip.Logger.Info("releasing the Nic and stopping.")
 					if _, err := fmt.Fprintln(os.Stderr, "releasing the Nic and stopping"); err != nil {
-						exoip.Logger.Crit(err.Error())
-					}
-					if err := engine.ReleaseMyNic(); err != nil {
-						exoip.Logger.Crit(err.Error())
-						os.Exit(1)
+						exoip.Logger.Crit("%s", err)
 					}
 				}
+				if err := engine.Stop(fmt.Sprintf("got sig %s", sig)); err != nil {
+					exoip.Logger.Crit("%s", err)
+					os.Exit(1)
+				}
 				os.Exit(0)
 			}
 		}
 	}()
 
 	if err := engine.UpdatePeers(); err != nil {
-		exoip.Logger.Crit(err.Error())
+		exoip.Logger.Crit("%s", err)
 	}
 
 	go func() {
 		// update list of peers, every 5 minutes
 		interval := 5 * time.Minute
 		var elapsed time.Duration
-		for !stopping {
+		for !stopped() {
 			start := time.Now()
 			if err := engine.UpdatePeers(); err != nil {
-				exoip.Logger.Crit(err.Error())
+				exoip.Logger.Crit("%s", err)
 			}
 
 			if err := engine.UpdateNic(); err != nil {
-				exoip.Logger.Crit(err.Error())
+				exoip.Logger.Crit("%s", err)
 			}
 			elapsed = time.Since(start)
 			time.Sleep(interval - elapsed)
 		}
 	}()
 
+	if leaseDuration > 0 {
+		go func() {
+			// renew the leases, three times per lease duration
+			interval := time.Duration(leaseDuration) / 3
+			for !stopped() {
+				time.Sleep(interval)
+				engine.RenewLeases()
+			}
+		}()
+	}
+
+	if reconcileInterval > 0 {
+		go func() {
+			// look for the EIPs on the other NICs, every reconcile interval
+			interval := time.Duration(reconcileInterval)
+			for !stopped() {
+				time.Sleep(interval)
+				if err := engine.Reconcile(); err != nil {
+					exoip.Logger.Crit("%s", err)
+				}
+			}
+		}()
+	}
+
 	go func() {
 		// pings our peers, every interval
 		var elapsed time.Duration
-		for !stopping {
+		for !stopped() {
 			start := time.Now()
 			if err := engine.PingPeers(); err != nil {
-				exoip.Logger.Crit(err.Error())
+				exoip.Logger.Crit("%s", err)
 			}
 			elapsed = time.Since(start)
 			if elapsed > engine.Interval {
 				exoip.Logger.Warning("PingPeers took longer than allowed interval (%dms): %dms", engine.Interval/time.Millisecond, elapsed/time.Millisecond)
 			}
 
-			time.Sleep(engine.Interval - elapsed)
+			// advertise a bit early rather than late
+			time.Sleep(engine.Interval - elapsed - engine.Jitter())
 		}
 	}()
 
 	go func() {
-		// act upon the peers state, every interval
+		// act upon the peers state, every interval or when asked to
 		var elapsed time.Duration
-		for !stopping {
+		for !stopped() {
 			start := time.Now()
 			engine.CheckState()
 			elapsed = time.Since(start)
@@ -458,13 +1163,15 @@ func main() {
 				exoip.Logger.Warning("CheckState took longer than allowed interval (%dms): %dms", engine.Interval/time.Millisecond, elapsed/time.Millisecond)
 			}
 
-			time.Sleep(engine.Interval - elapsed)
+			select {
+			case <-engine.CheckNow():
+			case <-time.After(engine.Interval - elapsed + engine.Jitter()):
+			}
 		}
 	}()
 
 	exoip.Logger.Info("starting watchdog")
-	err := engine.NetworkLoop()
-	if err != nil {
+	if err := engine.NetworkLoop(); err != nil {
 		panic(err)
 	}
 	os.Exit(0)
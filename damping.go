@@ -0,0 +1,107 @@
+package exoip
+
+import (
+	"math"
+	"time"
+)
+
+// Defaults of the flap damping
+const (
+	DefaultFlapHalfLife   = time.Minute
+	DefaultQuarantineTime = 5 * time.Minute
+)
+
+// DampingConfig describes how the flapping is damped
+type DampingConfig struct {
+	// MinMasterTime is how long a master stays so before stepping down for a better peer
+	MinMasterTime time.Duration
+	// Penalty worsens the advertised priority every time we become master again
+	Penalty int
+	// HalfLife is how long it takes for the penalty to be halved
+	HalfLife time.Duration
+	// QuarantineFlaps is how many times a peer may come back to life within QuarantineTime
+	QuarantineFlaps int
+	// QuarantineTime is how long a flapping peer is considered dead
+	QuarantineTime time.Duration
+}
+
+// flapPenalty returns the transition penalty, decayed since it was last raised
+func (group *Group) flapPenalty(now time.Time) float64 {
+	group.dampingMu.Lock()
+	defer group.dampingMu.Unlock()
+
+	return group.decayedPenalty(now)
+}
+
+// decayedPenalty computes the penalty at the given time, the lock must be held
+func (group *Group) decayedPenalty(now time.Time) float64 {
+	halfLife := group.engine.Damping.HalfLife
+	if group.penalty == 0 || halfLife <= 0 {
+		return group.penalty
+	}
+
+	return group.penalty * math.Pow(0.5, float64(now.Sub(group.penaltyAt))/float64(halfLife))
+}
+
+// recordTransition raises the penalty when becoming master again
+//
+// The penalty worsens our advertised priority so that the peers are
+// preferred over a node going back and forth. Only a flap, from master to
+// another state and back, is charged: the first election is not.
+func (group *Group) recordTransition(now time.Time, from, to State) {
+	if from == StateMaster {
+		group.masterSince = time.Time{}
+		group.leftMaster = true
+	}
+	if to != StateMaster {
+		return
+	}
+	group.masterSince = now
+
+	penalty := group.engine.Damping.Penalty
+	if penalty == 0 || !group.leftMaster {
+		return
+	}
+
+	group.dampingMu.Lock()
+	defer group.dampingMu.Unlock()
+
+	group.penalty = math.Min(group.decayedPenalty(now)+float64(penalty), 255)
+	group.penaltyAt = now
+	Logger.Info("group %d: flap penalty raised to %d", group.ID, int(group.penalty))
+}
+
+// holdsMaster tells for how long we must stay master before stepping down
+func (group *Group) holdsMaster(now time.Time) time.Duration {
+	if group.State != StateMaster || group.masterSince.IsZero() {
+		return 0
+	}
+
+	return group.masterSince.Add(group.engine.Damping.MinMasterTime).Sub(now)
+}
+
+// recordPeerFlap counts the returns to life of the peer
+//
+// After too many of them within the quarantine time, the peer is
+// considered dead for that long, whatever it advertises.
+func (group *Group) recordPeerFlap(now time.Time, peer *Peer) {
+	damping := group.engine.Damping
+	if damping.QuarantineFlaps == 0 {
+		return
+	}
+
+	flaps := peer.flaps[:0]
+	for _, flap := range peer.flaps {
+		if now.Sub(flap) < damping.QuarantineTime {
+			flaps = append(flaps, flap)
+		}
+	}
+	peer.flaps = append(flaps, now)
+
+	if len(peer.flaps) >= damping.QuarantineFlaps {
+		peer.QuarantinedUntil = now.Add(damping.QuarantineTime)
+		peer.flaps = nil
+		Logger.Warning("group %d: peer %s came back to life %d times within %s, quarantined until %s",
+			group.ID, peer.UDPAddr.IP, damping.QuarantineFlaps, damping.QuarantineTime, peer.QuarantinedUntil.Format(time.RFC3339))
+	}
+}
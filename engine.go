@@ -2,21 +2,34 @@ package exoip
 
 import (
 	"bytes"
-	"encoding/hex"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/exoscale/egoscale"
 )
 
 // ProtoVersion version of the protocol
-const ProtoVersion = "0201"
+const ProtoVersion = "0300"
 
 // Skew how much time to wait
+//
+// It is the upper bound, the skew is shortened to a fraction of the
+// interval when the latter is short.
 const Skew = 100 * time.Millisecond
 
+// MinInterval is the shortest advertisement interval supported
+const MinInterval = 10 * time.Millisecond
+
+// resignAdvertisements is how many times the resignation is advertised
+const resignAdvertisements = 3
+
 // Verbose makes the client talkative
 var Verbose = false
 
@@ -24,38 +37,23 @@ var Verbose = false
 var Logger *wrappedLogger
 
 // NewEngineWatchdog creates an new watchdog engine
-func NewEngineWatchdog(client *egoscale.Client, addr string, ip net.IP, instanceID egoscale.UUID, interval int,
-	prio int, deadRatio int, peers []string, securityGroupName string) *Engine {
+//
+// A peer is considered dead when it didn't advertise during deadTime.
+// When authKey is not empty, every advertisement is signed with it and
+// only the advertisements carrying a valid signature are accepted.
+func NewEngineWatchdog(client *egoscale.Client, addr string, groups []GroupConfig, instanceID egoscale.UUID, interval time.Duration,
+	deadTime time.Duration, peers []string, securityGroupName string, authKey []byte) *Engine {
 
 	zoneID, nicID, err := fetchMyInfo(client, instanceID)
 	assertSuccessOrExit(err)
 
-	sendbuf := make([]byte, payloadLength)
-	protobuf, err := hex.DecodeString(ProtoVersion)
-	assertSuccessOrExit(err)
-	netip := ip.To4()
-	if netip == nil {
-		Logger.Crit("IPv6 addresses are unsupported")
-		_, errP := fmt.Fprintf(os.Stderr, "IPv6 addresses are unsupported %q\n", ip)
-		if errP != nil {
-			panic(errP)
-		}
-		os.Exit(1)
+	if len(authKey) == 0 {
+		authKey = nil
 	}
 
-	netbytes := []byte(netip)
-
-	sendbuf[0] = protobuf[0]
-	sendbuf[1] = protobuf[1]
-	sendbuf[2] = byte(prio)
-	sendbuf[3] = byte(prio)
-	sendbuf[4] = netbytes[0]
-	sendbuf[5] = netbytes[1]
-	sendbuf[6] = netbytes[2]
-	sendbuf[7] = netbytes[3]
-
-	for i, b := range nicID.UUID {
-		sendbuf[i+8] = b
+	hostname, err := os.Hostname()
+	if err != nil {
+		Logger.Warning("could not get the hostname: %s", err)
 	}
 
 	serverAddr, err := net.ResolveUDPAddr("udp", addr)
@@ -65,51 +63,105 @@ func NewEngineWatchdog(client *egoscale.Client, addr string, ip net.IP, instance
 		client:            client,
 		ListenAddress:     addr,
 		listenPort:        serverAddr.Port,
-		DeadRatio:         deadRatio,
-		Interval:          time.Duration(interval) * time.Second,
-		priority:          sendbuf[2],
-		SendBuf:           sendbuf,
-		peers:             make(map[string]*Peer),
+		DeadTime:          deadTime,
+		Interval:          interval,
+		BootID:            uint64(time.Now().UnixNano()),
+		hostname:          hostname,
+		checkNow:          make(chan struct{}, 1),
+		groups:            make(map[byte]*Group),
+		conns:             make(map[string]*net.UDPConn),
 		SecurityGroupName: securityGroupName,
-		State:             StateBackup,
 		NicID:             nicID,
-		ElasticIP:         netip,
 		VirtualMachineID:  &instanceID,
 		ZoneID:            zoneID,
-		InitHoldOff:       time.Now().Add(time.Duration(int64(interval)*int64(deadRatio))*time.Second + Skew),
+		InitHoldOff:       time.Now().Add(deadTime + skew(interval)),
+		authKey:           authKey,
+		Retry: RetryConfig{
+			Attempts: DefaultAPIAttempts,
+			Timeout:  DefaultAPITimeout,
+			Breaker:  DefaultAPIBreaker,
+		},
+	}
+
+	for _, config := range groups {
+		group, err := engine.newGroup(config)
+		assertSuccessOrExit(err)
+
+		engine.groups[group.ID] = group
+		engine.groupIDs = append(engine.groupIDs, group.ID)
 	}
 
 	for _, peerAddress := range peers {
 		peer, err := engine.FetchPeer(peerAddress)
 		assertSuccessOrExit(err)
 
-		engine.peers[peerAddress] = peer
+		for _, group := range engine.Groups() {
+			group.peers[peerAddress] = NewPeer(engine.peerConn(peer.UDPAddr), peer.UDPAddr, *peer.VirtualMachineID, *peer.NicID)
+		}
 	}
 
 	return engine
 }
 
 // NewEngine creates a new engine
-func NewEngine(client *egoscale.Client, ipAddress net.IP, instanceID egoscale.UUID) *Engine {
-	ipAddress = ipAddress.To4()
-	if ipAddress == nil {
-		Logger.Crit("IPv6 addresses are not supported %q", ipAddress)
-		_, err := fmt.Fprintf(os.Stderr, "IPv6 addresses are not supported %q\n", ipAddress)
-		if err != nil {
-			panic(err)
-		}
-		os.Exit(1)
-	}
-
+func NewEngine(client *egoscale.Client, ipAddresses []net.IP, instanceID egoscale.UUID) *Engine {
 	engine := &Engine{
-		ElasticIP:        ipAddress,
 		client:           client,
+		groups:           make(map[byte]*Group),
 		VirtualMachineID: &instanceID,
+		Retry: RetryConfig{
+			Attempts: DefaultAPIAttempts,
+			Timeout:  DefaultAPITimeout,
+		},
+	}
+
+	for i, ipAddress := range ipAddresses {
+		ipAddress = canonicalIP(ipAddress)
+		if ipAddress == nil {
+			assertSuccessOrExit(fmt.Errorf("invalid IP address"))
+		}
+
+		group := &Group{
+			ID:        byte(i + 1),
+			ElasticIP: ipAddress,
+			peers:     make(map[string]*Peer),
+			engine:    engine,
+		}
+		engine.groups[group.ID] = group
+		engine.groupIDs = append(engine.groupIDs, group.ID)
 	}
+
 	engine.FetchNicAndVM()
 	return engine
 }
 
+// Groups returns the groups watched over, in the configuration order
+func (engine *Engine) Groups() []*Group {
+	groups := make([]*Group, len(engine.groupIDs))
+	for i, id := range engine.groupIDs {
+		groups[i] = engine.groups[id]
+	}
+	return groups
+}
+
+// groupByIP returns the group watching over the given EIP
+func (engine *Engine) groupByIP(ip net.IP) *Group {
+	for _, group := range engine.groups {
+		if group.ElasticIP.Equal(ip) {
+			return group
+		}
+	}
+	return nil
+}
+
+// configHash sums up the settings the peers of a group must agree on
+func (engine *Engine) configHash(config GroupConfig, ip net.IP) uint64 {
+	settings := fmt.Sprintf("%d|%s|%d|%d|%v|%v|%d|%v", config.ID, ip, engine.Interval/time.Millisecond, engine.DeadTime/time.Millisecond,
+		engine.authKey != nil, config.NoPreempt, config.PreemptDelay/time.Millisecond, config.Quorum)
+	sum := sha256.Sum256([]byte(settings))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
 // NetworkLoop starts the UDP server
 func (engine *Engine) NetworkLoop() error {
 	serverAddr, err := net.ResolveUDPAddr("udp", engine.ListenAddress)
@@ -119,7 +171,7 @@ func (engine *Engine) NetworkLoop() error {
 	assertSuccessOrExit(err)
 
 	Logger.Info("listening on %s", serverAddr)
-	buf := make([]byte, payloadLength)
+	buf := make([]byte, maxPayloadLength+authTagLength)
 	for {
 		n, addr, err := serverConn.ReadFromUDP(buf)
 		if err != nil {
@@ -127,22 +179,44 @@ func (engine *Engine) NetworkLoop() error {
 			os.Exit(1)
 		}
 
-		if bytes.Contains(buf, []byte("info")) {
+		if bytes.HasPrefix(buf[:n], []byte("info")) {
+			if err := authorizeRequest(engine.authKey, addr, buf[:n], "info"); err != nil {
+				engine.rejectUnauthenticated(addr, err)
+				continue
+			}
 			engine.Info()
 			continue
 		}
 
-		if n != payloadLength {
-			Logger.Warning("bad network payload")
-			continue
+		data := buf[:n]
+		if engine.authKey != nil {
+			data, err = verifyPayload(engine.authKey, data)
+			if err != nil {
+				engine.rejectUnauthenticated(addr, err)
+				continue
+			}
 		}
 
-		payload, err := NewPayload(buf)
+		payload, err := NewPayload(data)
 		if err != nil {
-			Logger.Warning("unparseable payload")
+			Logger.Warning("unparseable payload: %s", err)
+			continue
+		}
+
+		// the legacy payloads have no group, the EIP identifies it
+		var group *Group
+		if payload.Version == LegacyProtoVersion {
+			group = engine.groupByIP(payload.IP)
 		} else {
-			engine.UpdatePeer(*addr, payload)
+			group = engine.groups[payload.GroupID]
+		}
+
+		if group == nil {
+			Logger.Warning("peer %s sent message for unknown group %d (%s)", addr.IP, payload.GroupID, payload.IP)
+			continue
 		}
+
+		group.UpdatePeer(*addr, payload)
 	}
 }
 
@@ -150,33 +224,128 @@ func (engine *Engine) NetworkLoop() error {
 func (engine *Engine) Info() {
 	Logger.Info("VirtualMachine IP: %s", engine.VirtualMachineID)
 	Logger.Info("Nic IP: %s", engine.NicID)
-	Logger.Info("Elastic IP: %s", engine.ElasticIP.String())
-	Logger.Info("Dead ratio: %d", engine.DeadRatio)
-	Logger.Info("Priority: %d", engine.priority)
-	Logger.Info("State: %s", engine.State)
+	Logger.Info("Interval: %s", engine.Interval)
+	Logger.Info("Dead time: %s", engine.DeadTime)
+	Logger.Info("Boot ID: %d", engine.BootID)
+	Logger.Info("Sequence: %d", atomic.LoadUint64(&engine.sequence))
 	Logger.Info("Last Sent: %s", engine.LastSend.Format(time.RFC3339))
+	Logger.Info("Authentication: %v", engine.authKey != nil)
+	Logger.Info("Unauthenticated payloads: %d", atomic.LoadUint64(&engine.AuthFailures))
+	if down, why := engine.apiDown(); down {
+		Logger.Info("Circuit breaker: open, %s", why)
+	}
 
-	engine.peersMu.RLock()
-	defer engine.peersMu.RUnlock()
+	engine.trackersMu.Lock()
+	for _, tracker := range engine.trackers {
+		tracker.Info()
+	}
+	engine.trackersMu.Unlock()
 
-	for k, peer := range engine.peers {
-		Logger.Info("Peer: %s", k)
-		peer.Info()
+	for _, group := range engine.Groups() {
+		group.Info()
 	}
 }
 
-// PingPeers sends the SendBuf to each peer
+// PingPeers sends the advertisement of each group to its peers
+//
+// The sequence number is increased with every call so that the peers can
+// tell this advertisement from a replayed one. The calls are serialized so
+// that the advertisements are sent in the order of their sequence numbers,
+// e.g. the resignation isn't overtaken by a regular advertisement. The
+// peers that only speak the legacy protocol get a legacy advertisement,
+// unless authentication is enabled or the EIP is an IPv6 one, as the
+// legacy protocol can carry neither.
 func (engine *Engine) PingPeers() error {
-	engine.peersMu.RLock()
-	defer engine.peersMu.RUnlock()
+	engine.pingMu.Lock()
+	defer engine.pingMu.Unlock()
+
+	sequence := atomic.AddUint64(&engine.sequence, 1)
 
-	for _, peer := range engine.peers {
-		peer.Send(engine.SendBuf) // nolint: errcheck, gosec
+	for _, group := range engine.Groups() {
+		sendbuf, err := engine.marshal(group.newPayload(ProtoVersion, sequence))
+		if err != nil {
+			return err
+		}
+		group.SendBuf = sendbuf
+
+		var legacybuf []byte
+		group.peersMu.RLock()
+		for _, peer := range group.peers {
+			if !peer.Legacy {
+				peer.Send(sendbuf) // nolint: errcheck, gosec
+				continue
+			}
+
+			if engine.authKey != nil || !group.legacy {
+				continue
+			}
+
+			if legacybuf == nil {
+				legacybuf, err = engine.marshal(group.newPayload(LegacyProtoVersion, sequence))
+				if err != nil {
+					Logger.Warning("group %d: %s", group.ID, err)
+					continue
+				}
+			}
+			peer.Send(legacybuf) // nolint: errcheck, gosec
+		}
+		group.peersMu.RUnlock()
 	}
 	engine.LastSend = time.Now()
 	return nil
 }
 
+// Resign tells the peers that we are shutting down
+//
+// The advertisements sent from now on carry the resign option, so that
+// the peers elect a new master right away instead of waiting for us to be
+// considered dead. The legacy peers don't understand it.
+func (engine *Engine) Resign() error {
+	atomic.StoreUint32(&engine.resigning, 1)
+	return engine.PingPeers()
+}
+
+// marshal encodes the payload and signs it when authentication is enabled
+func (engine *Engine) marshal(payload *Payload) ([]byte, error) {
+	buf, err := payload.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if engine.authKey != nil {
+		buf = append(buf, make([]byte, authTagLength)...)
+		signPayload(engine.authKey, buf)
+	}
+
+	return buf, nil
+}
+
+// peerConn returns the connection to the peer, shared by all the groups
+func (engine *Engine) peerConn(raddr *net.UDPAddr) *net.UDPConn {
+	engine.connsMu.Lock()
+	defer engine.connsMu.Unlock()
+
+	key := raddr.String()
+	if conn, ok := engine.conns[key]; ok {
+		return conn
+	}
+
+	var laddr *net.UDPAddr
+	i := strings.IndexRune(engine.ListenAddress, ':')
+	if i > 0 {
+		local := engine.ListenAddress[0:i]
+		var err error
+		laddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:0", local))
+		assertSuccessOrExit(err)
+	}
+
+	conn, err := net.DialUDP("udp", laddr, raddr)
+	assertSuccessOrExit(err)
+
+	engine.conns[key] = conn
+	return conn
+}
+
 // FetchPeer fetches a Peer from its IP address
 func (engine *Engine) FetchPeer(peerAddress string) (*Peer, error) {
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", peerAddress, engine.listenPort))
@@ -184,7 +353,6 @@ func (engine *Engine) FetchPeer(peerAddress string) (*Peer, error) {
 		return nil, err
 	}
 
-	client := engine.client
 	query := egoscale.VirtualMachine{
 		Nic: []egoscale.Nic{{
 			IPAddress: addr.IP,
@@ -193,7 +361,7 @@ func (engine *Engine) FetchPeer(peerAddress string) (*Peer, error) {
 		ZoneID: engine.ZoneID,
 	}
 
-	resp, err := client.Get(query)
+	resp, err := engine.get(query)
 	if err != nil {
 		return nil, err
 	}
@@ -204,14 +372,12 @@ func (engine *Engine) FetchPeer(peerAddress string) (*Peer, error) {
 		return nil, fmt.Errorf("peer (%v) has no default nic", peerAddress)
 	}
 
-	return NewPeer(engine.ListenAddress, addr, *vm.ID, *nic.ID), nil
+	return NewPeer(engine.peerConn(addr), addr, *vm.ID, *nic.ID), nil
 }
 
 // FetchNicAndVM fetches our NIC and the VirtualMachine
 func (engine *Engine) FetchNicAndVM() {
-	client := engine.client
-
-	resp, err := client.Get(egoscale.VirtualMachine{
+	resp, err := engine.get(egoscale.VirtualMachine{
 		ID: engine.VirtualMachineID,
 	})
 	assertSuccessOrExit(err)
@@ -225,191 +391,148 @@ func (engine *Engine) FetchNicAndVM() {
 	engine.NicID = nic.ID
 }
 
-// ObtainNic add the elastic IP to the given NIC
-func (engine *Engine) ObtainNic(nicID egoscale.UUID) error {
-	client := engine.client
-
-	_, err := client.Request(&egoscale.AddIPToNic{
-		NicID:     &nicID,
-		IPAddress: engine.ElasticIP,
-	})
-
-	if err != nil {
-		Logger.Crit("could not add ip %s to nic %s: %s",
-			engine.ElasticIP,
-			nicID,
-			err)
-		return err
-	}
-
-	Logger.Info("claimed ip %s on nic %s", engine.ElasticIP, nicID)
-	return nil
-}
-
-// ReleaseMyNic releases the elastic IP from the NIC
-func (engine *Engine) ReleaseMyNic() error {
-	client := engine.client
-
-	resp, err := client.Get(egoscale.VirtualMachine{
+// fetchMyNic fetches our default NIC with its secondary IPs
+func (engine *Engine) fetchMyNic() (*egoscale.Nic, error) {
+	resp, err := engine.get(egoscale.VirtualMachine{
 		ID: engine.VirtualMachineID,
 	})
-
 	if err != nil {
-		Logger.Crit("could not get virtualmachine: %s. %s", engine.VirtualMachineID, err)
-		return err
+		return nil, fmt.Errorf("error fetching VM %s information, %s", engine.VirtualMachineID, err)
 	}
 
 	vm := resp.(*egoscale.VirtualMachine)
-	var nicAddressID *egoscale.UUID
 	nic := vm.DefaultNic()
-	if nic != nil {
-		for _, secIP := range nic.SecondaryIP {
-			if secIP.IPAddress == nil {
-				continue
-			}
-
-			if secIP.IPAddress.String() == engine.ElasticIP.String() {
-				nicAddressID = secIP.ID
-				break
-			}
-		}
-	}
-
-	if nicAddressID == nil {
-		Logger.Warning("could not remove ip from nic: unknown association")
-		return fmt.Errorf("could not remove ip from nic: unknown association")
+	if nic == nil {
+		return nil, fmt.Errorf("no default nic found for self")
 	}
 
-	req := &egoscale.RemoveIPFromNic{
-		ID: nicAddressID,
-	}
-	if err := client.BooleanRequest(req); err != nil {
-		Logger.Crit("could not disassociate ip %s (%s): %s",
-			engine.ElasticIP.String(), nicAddressID, err)
-		return err
+	if !nic.ID.Equal(*engine.NicID) {
+		return nil, fmt.Errorf("default nic ID doesn't match")
 	}
 
-	Logger.Info("released ip %s", engine.ElasticIP.String())
-	return nil
+	return nic, nil
 }
 
-// ReleaseNic removes the Elastic IP from the given NIC
-func (engine *Engine) ReleaseNic(vmID, nicID egoscale.UUID) error {
-	client := engine.client
+// UpdateNic checks if the EIPs must be reattached to self
+//
+// Our VM is fetched once for all the groups, whose states are locked
+// meanwhile. The groups whose term is stale are left alone.
+func (engine *Engine) UpdateNic() error {
+	groups := engine.Groups()
+	for _, group := range groups {
+		group.stateMu.Lock()
+		defer group.stateMu.Unlock()
+	}
 
-	resp, err := client.Get(egoscale.VirtualMachine{
-		ID: &vmID,
-	})
+	nic, err := engine.fetchMyNic()
 	if err != nil {
-		Logger.Crit("could not remove IP from NIC VM:%s. %s", vmID, err)
 		return err
 	}
 
-	vm := resp.(*egoscale.VirtualMachine)
-	var nicAddressID *egoscale.UUID
-	nic := vm.DefaultNic()
-	if nic != nil && nic.ID.Equal(nicID) {
-		for _, secIP := range nic.SecondaryIP {
-			if secIP.IPAddress.Equal(engine.ElasticIP) {
-				nicAddressID = secIP.ID
-				break
-			}
+	var lastErr error
+	for _, group := range groups {
+		// a newer master may have taken over while we were fetching
+		if err := group.checkTerm(); err != nil {
+			Logger.Crit("%s", err)
+			lastErr = err
+			continue
 		}
-	}
-
-	if nicAddressID == nil {
-		Logger.Warning("vm %s doesn't hold the ipaddress %s", vmID, engine.ElasticIP)
-		return fmt.Errorf("vm %s doesn't hold the ipaddress %s", vmID, engine.ElasticIP)
-	}
 
-	req := &egoscale.RemoveIPFromNic{ID: nicAddressID}
-	if err := client.BooleanRequest(req); err != nil {
-		Logger.Crit("could not remove ip from nic %s (%s): %s", nicID, nicAddressID, err)
-		return err
+		if err := group.updateNic(nic); err != nil {
+			Logger.Crit("group %d: %s", group.ID, err)
+			lastErr = err
+		}
 	}
 
-	Logger.Info("released ip %s from nic %s", engine.ElasticIP.String(), nicID)
-	return nil
+	return lastErr
 }
 
-// UpdateNic checks if the EIP must be reattached to self
-func (engine *Engine) UpdateNic() error {
-	client := engine.client
+// IsMaster tells whether we are master of any group
+func (engine *Engine) IsMaster() bool {
+	for _, group := range engine.Groups() {
+		group.stateMu.Lock()
+		master := group.State == StateMaster
+		group.stateMu.Unlock()
 
-	resp, err := client.Get(egoscale.VirtualMachine{
-		ID: engine.VirtualMachineID,
-	})
-	if err != nil {
-		return fmt.Errorf("error fetching VM %s information, %s", engine.VirtualMachineID, err)
+		if master {
+			return true
+		}
 	}
+	return false
+}
 
-	vm := resp.(*egoscale.VirtualMachine)
-	nic := vm.DefaultNic()
-	if nic == nil {
-		return fmt.Errorf("no default nic found for self")
-	}
+// Stop resigns from every group and releases the elastic IPs we are master of
+//
+// The groups enter the stopping state, which they never leave. The
+// resignation is advertised a few times, one per interval, in case one
+// gets lost.
+func (engine *Engine) Stop(reason string) error {
+	masters := make([]*Group, 0, len(engine.groups))
+	for _, group := range engine.Groups() {
+		group.stateMu.Lock()
+		if group.State == StateMaster {
+			masters = append(masters, group)
+		}
 
-	if !nic.ID.Equal(*engine.NicID) {
-		return fmt.Errorf("default nic ID doesn't match")
+		if err := group.transition(StateStopping, reason); err != nil {
+			Logger.Warning("%s", err)
+		}
+		group.stateMu.Unlock()
 	}
 
-	found := false
-	for _, secIP := range nic.SecondaryIP {
-		if secIP.IPAddress.Equal(engine.ElasticIP) {
-			// we still hold the EIP
-			found = true
-			break
-		}
+	if err := engine.Resign(); err != nil {
+		Logger.Crit("%s", err)
 	}
+	sent := time.Now()
 
-	// disassociate the IP from self if still present and backup
-	if engine.State == StateBackup && found {
-		Logger.Warning("state is %s but the eip was found, release", engine.State)
-		return engine.ReleaseNic(*engine.VirtualMachineID, *engine.NicID)
+	var lastErr error
+	for _, group := range masters {
+		group.stateMu.Lock()
+		if err := group.ReleaseMyNic(); err != nil {
+			lastErr = err
+		}
+		group.stateMu.Unlock()
 	}
 
-	// associate the IP to self if missing and Master
-	if engine.State == StateMaster && !found {
-		Logger.Warning("state is %s but the eip was missing, obtain", engine.State)
-		return engine.ObtainNic(*engine.NicID)
+	// a single lost advertisement would leave the peers waiting for the dead time
+	for i := 1; i < resignAdvertisements && engine.Interval > 0; i++ {
+		time.Sleep(engine.Interval - time.Since(sent))
+		if err := engine.PingPeers(); err != nil {
+			Logger.Crit("%s", err)
+		}
+		sent = time.Now()
 	}
 
-	return nil
+	return lastErr
 }
 
 // UpdatePeers refreshes the list of the peers based on the security group
+//
+// The virtual machines are listed once and the peers of every group are
+// updated from that list.
 func (engine *Engine) UpdatePeers() error {
 	if engine.SecurityGroupName == "" {
 		// skip
 		return nil
 	}
 
-	client := engine.client
 	vm := &egoscale.VirtualMachine{
 		State:  "Running",
 		ZoneID: engine.ZoneID,
 	}
 
 	Logger.Info("updating peers %s (zone: %s)", engine.SecurityGroupName, engine.ZoneID)
-	vms, err := client.List(vm)
+	vms, err := engine.list(vm)
 	if err != nil {
 		return err
 	}
 
-	// grab the right to alter the Peers
-	engine.peersMu.Lock()
-	defer engine.peersMu.Unlock()
-
-	knownPeers := make(map[string]interface{})
-	for key := range engine.peers {
-		knownPeers[key] = nil
-	}
-
+	found := make(map[string]*egoscale.VirtualMachine)
 	for _, v := range vms {
 		vm := v.(*egoscale.VirtualMachine)
 
 		// skip self
-		if vm.ID == engine.VirtualMachineID {
+		if vm.ID.Equal(*engine.VirtualMachineID) {
 			continue
 		}
 
@@ -418,107 +541,57 @@ func (engine *Engine) UpdatePeers() error {
 			continue
 		}
 
-		for _, sg := range vm.SecurityGroup {
-			if sg.Name != engine.SecurityGroupName {
-				continue
-			}
-
-			key := ip.String()
-			if _, ok := engine.peers[key]; !ok {
-				// add peer
-				addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", key, engine.listenPort))
-				if err != nil {
-					Logger.Warning(err.Error())
-					return err
-				}
-
-				Logger.Info("found new peer %s (vm: %s)", key, vm.ID)
-				nic := vm.DefaultNic()
-				if nic == nil {
-					Logger.Warning("no default nic found for %q", vm.ID)
-				} else {
-					engine.peers[key] = NewPeer(engine.ListenAddress, addr, *vm.ID, *nic.ID)
-				}
-			} else {
-				delete(knownPeers, key)
-			}
+		if VMHasSecurityGroup(vm, engine.SecurityGroupName) {
+			found[ip.String()] = vm
 		}
 	}
 
-	// Remove extra peers from list of known peers
-	for key := range knownPeers {
-		Logger.Info("removing peer %s", key)
-		delete(engine.peers, key)
+	for _, group := range engine.Groups() {
+		if err := group.updatePeers(found); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// UpdatePeer update the state of the given peer
-func (engine *Engine) UpdatePeer(addr net.UDPAddr, payload *Payload) {
-	if !engine.ElasticIP.Equal(payload.IP) {
-		Logger.Warning("peer sent message for wrong EIP, got %s", payload.IP.String())
-		return
-	}
-
-	engine.peersMu.Lock()
-	defer engine.peersMu.Unlock()
-	if peer, ok := engine.peers[addr.IP.String()]; ok {
-		peer.Priority = payload.Priority
-		peer.NicID = payload.NicID
-		peer.LastSeen = time.Now()
-		return
-	}
-
-	Logger.Warning("peer %s not found in configuration", addr.IP.String())
-}
-
-// PeerIsNewlyDead contains the logic to say if the peer is considered dead
-func (engine *Engine) PeerIsNewlyDead(now time.Time, peer *Peer) bool {
-	peerDiff := now.Sub(peer.LastSeen)
-	dead := peerDiff > (engine.Interval * time.Duration(engine.DeadRatio))
-	if dead != peer.Dead {
-		if dead {
-			Logger.Info("peer %s last seen %s (%dms ago), considering dead.", peer.UDPAddr.IP, peer.LastSeen.Format(time.RFC3339), peerDiff/time.Millisecond)
-		} else {
-			Logger.Info("peer %s, is now back alive.", peer.UDPAddr.IP)
-		}
-		peer.Dead = dead
-		return dead
+// TriggerCheck asks for the states to be checked without waiting for the next tick
+func (engine *Engine) TriggerCheck() {
+	select {
+	case engine.checkNow <- struct{}{}:
+	default:
 	}
-	return false
 }
 
-// BackupOf tells if we are a backup of the given peer
-func (engine *Engine) BackupOf(peer *Peer) bool {
-	return (!peer.Dead && peer.Priority < engine.priority)
+// CheckNow is the channel signaling that the states must be checked right away
+func (engine *Engine) CheckNow() <-chan struct{} {
+	return engine.checkNow
 }
 
-// PerformStateTransition transition to the given state
-func (engine *Engine) PerformStateTransition(state State) error {
-
-	if engine.State == state {
-		return nil
+// skew returns how long to wait before checking the states
+func skew(interval time.Duration) time.Duration {
+	if interval/4 < Skew {
+		return interval / 4
 	}
+	return Skew
+}
 
-	Logger.Info("switching state to %s", state)
-
-	oldState := engine.State
-	engine.State = state
-
-	err := engine.UpdateNic()
-	if err != nil {
-		engine.State = oldState
-		return err
+// Jitter returns a random duration of up to a tenth of the interval
+//
+// It spreads the advertisements and the checks so that the peers don't
+// stay in lockstep.
+func (engine *Engine) Jitter() time.Duration {
+	max := int64(engine.Interval / 10)
+	if max <= 0 {
+		return 0
 	}
-
-	return nil
+	return time.Duration(rand.Int63n(max)) // nolint: gosec
 }
 
-// CheckState updates the states of our peers
+// CheckState updates the states of every group
 func (engine *Engine) CheckState() {
 
-	time.Sleep(Skew)
+	time.Sleep(skew(engine.Interval))
 
 	now := time.Now()
 
@@ -526,67 +599,11 @@ func (engine *Engine) CheckState() {
 		return
 	}
 
-	deadPeers := make([]*Peer, 0)
-	bestAdvertisement := true
-
-	engine.peersMu.RLock()
-	defer engine.peersMu.RUnlock()
-
-	for _, peer := range engine.peers {
-		if engine.PeerIsNewlyDead(now, peer) {
-			deadPeers = append(deadPeers, peer)
-		} else {
-			if engine.BackupOf(peer) {
-				bestAdvertisement = false
-			}
-		}
-	}
-
-	var err error
-	if bestAdvertisement {
-		err = engine.PerformStateTransition(StateMaster)
-	} else {
-		err = engine.PerformStateTransition(StateBackup)
-	}
-
-	if err != nil {
-		Logger.Crit("could not switch state. %s", err)
+	if engine.APIDown() {
+		engine.probeAPI(now)
 	}
 
-	// Disconnect the dead peers from their NIC
-	// and reobtain the Nic for ourself (split-brain)
-	if len(deadPeers) > 0 {
-		for _, peer := range deadPeers {
-			err := engine.ReleaseNic(*peer.VirtualMachineID, *peer.NicID)
-			if err != nil {
-				Logger.Crit(err.Error())
-			}
-		}
-
-		if err := engine.UpdateNic(); err != nil {
-			Logger.Crit(err.Error())
-		}
-	}
-}
-
-// LowerPriority lowers the priority value (making it more important)
-func (engine *Engine) LowerPriority() (byte, error) {
-	if engine.priority > 1 {
-		engine.priority--
-		engine.SendBuf[2] = engine.priority
-		engine.SendBuf[3] = engine.priority
-		return engine.priority, nil
-	}
-	return engine.priority, fmt.Errorf("priority cannot be lowered any more")
-}
-
-// RaisePriority raises the priority value (making it less important)
-func (engine *Engine) RaisePriority() (byte, error) {
-	if engine.priority < 255 {
-		engine.priority++
-		engine.SendBuf[2] = engine.priority
-		engine.SendBuf[3] = engine.priority
-		return engine.priority, nil
+	for _, group := range engine.Groups() {
+		group.CheckState(now)
 	}
-	return engine.priority, fmt.Errorf("priority cannot be raised any more")
 }
@@ -0,0 +1,11 @@
+package exoip
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	SetupLogger(true)
+	os.Exit(m.Run())
+}
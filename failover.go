@@ -0,0 +1,112 @@
+package exoip
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+// verifyAttempts is how many times a NIC is read back after a job
+const verifyAttempts = 5
+
+// Failover is the timeline of an operation on the EIP
+type Failover struct {
+	// Action is what was done, e.g. obtain or release
+	Action string
+	NicID  egoscale.UUID
+	Term   uint64
+	// Detected is when the need for the operation was noticed
+	Detected time.Time
+	// Submitted is when the job was submitted to the API
+	Submitted time.Time
+	// Completed is when the job completed
+	Completed time.Time
+	// Visible is when the NIC was read back as expected, zero if it never was
+	Visible time.Time
+}
+
+// String returns the timeline relative to the detection
+func (failover *Failover) String() string {
+	since := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return "+" + t.Sub(failover.Detected).Round(time.Millisecond).String()
+	}
+
+	return fmt.Sprintf("%s on nic %s (term %d): detected at %s, job submitted %s, job completed %s, visible on nic %s",
+		failover.Action, failover.NicID, failover.Term, failover.Detected.Format(time.RFC3339),
+		since(failover.Submitted), since(failover.Completed), since(failover.Visible))
+}
+
+// detected records when a transition requiring to touch the EIP was decided, zero to forget it
+func (group *Group) detected(now time.Time) {
+	group.detectedAt = now
+}
+
+// newFailover starts the timeline of an operation on the given NIC
+//
+// The detection is the last transition, unless it was consumed already by
+// another operation, e.g. the operation fixes a drift.
+func (group *Group) newFailover(action string, nicID egoscale.UUID) *Failover {
+	now := time.Now()
+	detected := group.detectedAt
+	if detected.IsZero() {
+		detected = now
+	}
+	group.detectedAt = time.Time{}
+
+	return &Failover{
+		Action:    action,
+		NicID:     nicID,
+		Term:      group.term(),
+		Detected:  detected,
+		Submitted: now,
+	}
+}
+
+// recordFailover keeps the timeline, logging it
+func (group *Group) recordFailover(failover *Failover) {
+	group.LastFailover = *failover
+	if failover.Visible.IsZero() {
+		group.VerifyFailures++
+		Logger.Crit("group %d: ip %s, %s", group.ID, group.ElasticIP, failover)
+		return
+	}
+	Logger.Info("group %d: ip %s, %s", group.ID, group.ElasticIP, failover)
+}
+
+// verifyNic reads the NIC back until it holds the EIP, or not
+//
+// The completion of the job doesn't tell that the NIC reflects it yet.
+// A NIC still not as expected after a few reads is an error.
+func (group *Group) verifyNic(vmID, nicID egoscale.UUID, held bool) (time.Time, error) {
+	engine := group.engine
+
+	var err error
+	for attempt := 1; attempt <= verifyAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff(attempt - 1))
+		}
+
+		var resp interface{}
+		resp, err = engine.get(egoscale.VirtualMachine{ID: &vmID})
+		if err != nil {
+			continue
+		}
+
+		if holds(resp.(*egoscale.VirtualMachine), nicID, group.ElasticIP) == held {
+			return time.Now(), nil
+		}
+		err = nil
+	}
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not verify ip %s on nic %s: %s", group.ElasticIP, nicID, err)
+	}
+	if held {
+		return time.Time{}, fmt.Errorf("ip %s is still missing from nic %s after %d reads", group.ElasticIP, nicID, verifyAttempts)
+	}
+	return time.Time{}, fmt.Errorf("ip %s is still on nic %s after %d reads", group.ElasticIP, nicID, verifyAttempts)
+}
@@ -0,0 +1,165 @@
+package exoip
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+// DefaultFenceInterval is the shortest time between two fencing actions by default
+const DefaultFenceInterval = 5 * time.Minute
+
+// FencePolicy tells what is done to a dead peer, besides releasing the EIP
+type FencePolicy int
+
+const (
+	// FenceNone only releases the EIP from the default NIC of the peer
+	FenceNone FencePolicy = iota
+	// FenceIsolate releases the EIP from every NIC of the peer
+	FenceIsolate
+	// FenceStop stops the instance of the peer
+	FenceStop
+	// FenceReboot reboots the instance of the peer
+	FenceReboot
+)
+
+var fencePolicies = map[string]FencePolicy{
+	"none":    FenceNone,
+	"isolate": FenceIsolate,
+	"stop":    FenceStop,
+	"reboot":  FenceReboot,
+}
+
+// ParseFencePolicy reads a policy: none, isolate, stop or reboot
+func ParseFencePolicy(policy string) (FencePolicy, error) {
+	p, ok := fencePolicies[policy]
+	if !ok {
+		return FenceNone, fmt.Errorf("unknown fence policy %q (none, isolate, stop or reboot)", policy)
+	}
+	return p, nil
+}
+
+// String returns the name of the policy
+func (policy FencePolicy) String() string {
+	for name, p := range fencePolicies {
+		if p == policy {
+			return name
+		}
+	}
+	return fmt.Sprintf("FencePolicy(%d)", int(policy))
+}
+
+// FenceConfig describes how the dead peers are fenced
+type FenceConfig struct {
+	Policy FencePolicy
+	// Interval is the shortest time between two fencing actions
+	Interval time.Duration
+}
+
+// fence takes the dead peer out of the way, following the fencing policy
+//
+// Only the master fences and only once a majority of the group agrees that
+// the peer is dead, whatever the quorum mode. We never fence ourself, a
+// peer that resigned, a witness nor a peer that never advertised, and at
+// most one peer is fenced every interval. The fencing itself runs in the
+// background.
+func (group *Group) fence(dead deadPeer, reason string) error {
+	engine := group.engine
+	policy := engine.Fence.Policy
+
+	if policy == FenceNone || dead.resigned || group.State != StateMaster {
+		return nil
+	}
+
+	if dead.vmID == nil || dead.vmID.Equal(*engine.VirtualMachineID) {
+		return fmt.Errorf("group %d: refusing to fence peer %s: it is ourself", group.ID, dead.ip)
+	}
+
+	if dead.witness {
+		return fmt.Errorf("group %d: not fencing peer %s: it is a witness", group.ID, dead.ip)
+	}
+
+	if dead.lastSeen.IsZero() {
+		return fmt.Errorf("group %d: not fencing peer %s: it never advertised", group.ID, dead.ip)
+	}
+
+	if votes, majority := dead.votes, dead.majority; votes < majority {
+		return fmt.Errorf("group %d: not fencing peer %s without a quorum (%d votes out of %d needed)",
+			group.ID, dead.ip, votes, majority)
+	}
+
+	engine.fenceMu.Lock()
+	now := time.Now()
+	if elapsed := now.Sub(engine.lastFence); elapsed < engine.Fence.Interval {
+		engine.fenceMu.Unlock()
+		return fmt.Errorf("group %d: not fencing peer %s, the last fencing was %s ago",
+			group.ID, dead.ip, elapsed.Round(time.Second))
+	}
+	engine.lastFence = now
+	engine.fenceMu.Unlock()
+
+	vmID := *dead.vmID
+	ip := dead.ip
+	term := group.term()
+	Logger.Warning("group %d: fencing peer %s (vm %s) with policy %s (term %d): %s",
+		group.ID, ip, vmID, policy, term, reason)
+
+	go func() {
+		var err error
+		switch policy {
+		case FenceIsolate:
+			err = group.releaseAllNics(vmID)
+		case FenceStop:
+			_, err = engine.request(&egoscale.StopVirtualMachine{ID: &vmID}, engine.vmStopped(vmID))
+		case FenceReboot:
+			// whether a reboot went through cannot be told
+			_, err = engine.request(&egoscale.RebootVirtualMachine{ID: &vmID}, nil)
+		}
+
+		if err != nil {
+			Logger.Crit("group %d: could not fence peer %s (vm %s, term %d): %s", group.ID, ip, vmID, term, err)
+			return
+		}
+		Logger.Info("group %d: fenced peer %s (vm %s) with policy %s (term %d)", group.ID, ip, vmID, policy, term)
+	}()
+
+	return nil
+}
+
+// fenceMajority is the number of votes needed to fence, ours included
+//
+// The witnesses, which never hold the EIP, and the peers that never
+// advertised, e.g. a monitor, don't count.
+func (group *Group) fenceMajority() int {
+	return group.majorityOf(func(peer *Peer) bool {
+		return peer.Features&FeatureWitness == 0 && !peer.LastSeen.IsZero()
+	})
+}
+
+// releaseAllNics removes the Elastic IP from every NIC of the given virtual machine
+func (group *Group) releaseAllNics(vmID egoscale.UUID) error {
+	engine := group.engine
+
+	resp, err := engine.get(egoscale.VirtualMachine{ID: &vmID})
+	if err != nil {
+		return err
+	}
+
+	vm := resp.(*egoscale.VirtualMachine)
+	for _, nic := range vm.Nic {
+		for _, secIP := range nic.SecondaryIP {
+			if !secIP.IPAddress.Equal(group.ElasticIP) {
+				continue
+			}
+
+			done := engine.nicHolds(vmID, *nic.ID, group.ElasticIP, false)
+			if err := engine.booleanRequest(&egoscale.RemoveIPFromNic{ID: secIP.ID}, done); err != nil {
+				return err
+			}
+			Logger.Info("released ip %s from nic %s (term %d)", group.ElasticIP, nic.ID, group.term())
+		}
+	}
+
+	return nil
+}
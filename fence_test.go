@@ -0,0 +1,22 @@
+package exoip
+
+import "testing"
+
+func TestParseFencePolicy(t *testing.T) {
+	for _, name := range []string{"none", "isolate", "stop", "reboot"} {
+		policy, err := ParseFencePolicy(name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if policy.String() != name {
+			t.Errorf("%s: got policy %s", name, policy)
+		}
+	}
+
+	for _, name := range []string{"", "kill", "Stop"} {
+		if policy, err := ParseFencePolicy(name); err == nil {
+			t.Errorf("%q: got policy %s, want an error", name, policy)
+		}
+	}
+}
@@ -0,0 +1,1034 @@
+package exoip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+// DefaultGroupID is the ID of the group when a single EIP is watched over
+const DefaultGroupID = 1
+
+// GroupConfig describes a group to watch over
+type GroupConfig struct {
+	ID        byte
+	ElasticIP net.IP
+	Priority  int
+	// NoPreempt lets the current master keep the EIP until it fails
+	NoPreempt bool
+	// Quorum requires a majority to agree that a peer is dead before acting
+	Quorum bool
+	// PreemptDelay is how long a better peer must be alive before taking over
+	PreemptDelay time.Duration
+}
+
+// ParseGroupConfig parses a group definition of the form ID=EIP[@PRIORITY]
+//
+// The given priority is used when the definition doesn't set one.
+func ParseGroupConfig(definition string, priority int) (GroupConfig, error) {
+	config := GroupConfig{Priority: priority}
+
+	i := strings.IndexRune(definition, '=')
+	if i < 0 {
+		return config, fmt.Errorf("group %q: missing group ID (ID=EIP[@PRIORITY])", definition)
+	}
+
+	id, err := strconv.ParseUint(definition[:i], 10, 8)
+	if err != nil || id == 0 {
+		return config, fmt.Errorf("group %q: invalid group ID (must be 1-255)", definition)
+	}
+	config.ID = byte(id)
+
+	address := definition[i+1:]
+	if j := strings.LastIndex(address, "@"); j >= 0 {
+		config.Priority, err = strconv.Atoi(address[j+1:])
+		if err != nil {
+			return config, fmt.Errorf("group %q: invalid priority", definition)
+		}
+		address = address[:j]
+	}
+
+	if config.Priority < 0 || config.Priority > 255 {
+		return config, fmt.Errorf("group %q: invalid priority (must be 0-255)", definition)
+	}
+
+	config.ElasticIP = net.ParseIP(address)
+	if config.ElasticIP == nil {
+		return config, fmt.Errorf("group %q: not a valid IP Address", definition)
+	}
+
+	return config, nil
+}
+
+// newGroup creates a group of the engine
+func (engine *Engine) newGroup(config GroupConfig) (*Group, error) {
+	if _, ok := engine.groups[config.ID]; ok {
+		return nil, fmt.Errorf("group %d is defined twice", config.ID)
+	}
+
+	netip := canonicalIP(config.ElasticIP)
+	if netip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", config.ElasticIP)
+	}
+
+	for _, group := range engine.groups {
+		if group.ElasticIP.Equal(netip) {
+			return nil, fmt.Errorf("ip %s is watched over by groups %d and %d", netip, group.ID, config.ID)
+		}
+	}
+
+	return &Group{
+		ID:           config.ID,
+		ElasticIP:    netip,
+		State:        StateInit,
+		stateValue:   int32(StateInit),
+		priority:     byte(config.Priority),
+		noPreempt:    config.NoPreempt,
+		quorum:       config.Quorum,
+		preemptDelay: config.PreemptDelay,
+		configHash:   engine.configHash(config, netip),
+		legacy:       netip.To4() != nil,
+		peers:        make(map[string]*Peer),
+		engine:       engine,
+	}, nil
+}
+
+// newPayload builds the advertisement of the group using the given protocol version
+// and sequence number
+func (group *Group) newPayload(version string, sequence uint64) *Payload {
+	engine := group.engine
+
+	features := Features(0)
+	if engine.authKey != nil {
+		features |= FeatureAuthentication
+	}
+	if engine.Witness {
+		features |= FeatureWitness
+	}
+
+	deadPeers := make([]*egoscale.UUID, 0)
+	group.peersMu.RLock()
+	for _, peer := range group.peers {
+		if peer.Dead && !peer.Resigned {
+			deadPeers = append(deadPeers, peer.NicID)
+		}
+	}
+	group.peersMu.RUnlock()
+
+	return &Payload{
+		Version:    version,
+		Priority:   group.advertisedPriority(),
+		GroupID:    group.ID,
+		IP:         group.ElasticIP,
+		NicID:      engine.NicID,
+		BootID:     engine.BootID,
+		Sequence:   sequence,
+		State:      group.state(),
+		Interval:   engine.Interval,
+		ConfigHash: group.configHash,
+		Hostname:   engine.hostname,
+		Features:   features,
+		Resign:     atomic.LoadUint32(&engine.resigning) != 0,
+		DeadPeers:  deadPeers,
+		Term:       group.term(),
+	}
+}
+
+// Info logs the group current state (for debugging)
+func (group *Group) Info() {
+	Logger.Info("Group: %d", group.ID)
+	Logger.Info("Elastic IP: %s", group.ElasticIP.String())
+	Logger.Info("Priority: %d", group.priority)
+	Logger.Info("Advertised priority: %d", group.advertisedPriority())
+	Logger.Info("State: %s", group.state())
+	Logger.Info("Term: %d", group.term())
+	Logger.Info("Master term: %d", group.masterTerm)
+	Logger.Info("Flap penalty: %d", int(group.flapPenalty(time.Now())))
+	if !group.masterSince.IsZero() {
+		Logger.Info("Master since: %s", group.masterSince.Format(time.RFC3339))
+	}
+	if group.engine.LeaseDuration > 0 {
+		group.leaseMu.Lock()
+		Logger.Info("Lease until: %s", group.leaseExpiry.Format(time.RFC3339))
+		group.leaseMu.Unlock()
+	}
+	Logger.Info("Config hash: %016x", group.configHash)
+	Logger.Info("Dual masters: %d", group.DualMasters)
+	Logger.Info("Drifts: %d", group.Drifts)
+	Logger.Info("Verify failures: %d", group.VerifyFailures)
+	if !group.LastFailover.Detected.IsZero() {
+		Logger.Info("Last failover: %s", &group.LastFailover)
+	}
+
+	group.peersMu.RLock()
+	defer group.peersMu.RUnlock()
+
+	for k, peer := range group.peers {
+		Logger.Info("Peer: %s", k)
+		peer.Info()
+	}
+}
+
+// ObtainNic add the elastic IP to the given NIC
+//
+// Like every operation on the EIP, it is run with the state lock held.
+func (group *Group) ObtainNic(nicID egoscale.UUID) error {
+	engine := group.engine
+
+	if group.engine.Witness {
+		return fmt.Errorf("a witness never obtains the ip %s", group.ElasticIP)
+	}
+
+	if err := group.checkTerm(); err != nil {
+		Logger.Warning("%s", err)
+		return err
+	}
+
+	failover := group.newFailover("obtain", nicID)
+	_, err := engine.request(&egoscale.AddIPToNic{
+		NicID:     &nicID,
+		IPAddress: group.ElasticIP,
+	}, engine.nicHolds(*engine.VirtualMachineID, nicID, group.ElasticIP, true))
+
+	if err != nil {
+		Logger.Crit("could not add ip %s to nic %s (term %d): %s",
+			group.ElasticIP,
+			nicID,
+			group.masterTerm,
+			err)
+		return err
+	}
+	failover.Completed = time.Now()
+
+	// we don't own the EIP until the NIC says so
+	failover.Visible, err = group.verifyNic(*engine.VirtualMachineID, nicID, true)
+	group.recordFailover(failover)
+	if err != nil {
+		return err
+	}
+
+	Logger.Info("claimed ip %s on nic %s (term %d)", group.ElasticIP, nicID, group.masterTerm)
+	return nil
+}
+
+// ReleaseMyNic releases the elastic IP from the NIC
+//
+// Like every operation on the EIP, it is run with the state lock held.
+func (group *Group) ReleaseMyNic() error {
+	engine := group.engine
+
+	resp, err := engine.get(egoscale.VirtualMachine{
+		ID: engine.VirtualMachineID,
+	})
+
+	if err != nil {
+		Logger.Crit("could not get virtualmachine: %s. %s", engine.VirtualMachineID, err)
+		return err
+	}
+
+	vm := resp.(*egoscale.VirtualMachine)
+	var nicAddressID *egoscale.UUID
+	nic := vm.DefaultNic()
+	if nic != nil {
+		for _, secIP := range nic.SecondaryIP {
+			if secIP.IPAddress.Equal(group.ElasticIP) {
+				nicAddressID = secIP.ID
+				break
+			}
+		}
+	}
+
+	if nicAddressID == nil {
+		Logger.Warning("could not remove ip from nic: unknown association")
+		return fmt.Errorf("could not remove ip from nic: unknown association")
+	}
+
+	failover := group.newFailover("release", *nic.ID)
+	req := &egoscale.RemoveIPFromNic{
+		ID: nicAddressID,
+	}
+	if err := engine.booleanRequest(req, engine.nicHolds(*engine.VirtualMachineID, *nic.ID, group.ElasticIP, false)); err != nil {
+		Logger.Crit("could not disassociate ip %s (%s, term %d): %s",
+			group.ElasticIP.String(), nicAddressID, group.term(), err)
+		return err
+	}
+	failover.Completed = time.Now()
+
+	failover.Visible, err = group.verifyNic(*engine.VirtualMachineID, *nic.ID, false)
+	group.recordFailover(failover)
+	if err != nil {
+		return err
+	}
+
+	Logger.Info("released ip %s (term %d)", group.ElasticIP.String(), group.term())
+	return nil
+}
+
+// ReleaseNic removes the Elastic IP from the given NIC
+//
+// Like every operation on the EIP, it is run with the state lock held.
+func (group *Group) ReleaseNic(vmID, nicID egoscale.UUID) error {
+	engine := group.engine
+
+	resp, err := engine.get(egoscale.VirtualMachine{
+		ID: &vmID,
+	})
+	if err != nil {
+		Logger.Crit("could not remove IP from NIC VM:%s. %s", vmID, err)
+		return err
+	}
+
+	vm := resp.(*egoscale.VirtualMachine)
+	var nicAddressID *egoscale.UUID
+	nic := vm.DefaultNic()
+	if nic != nil && nic.ID.Equal(nicID) {
+		for _, secIP := range nic.SecondaryIP {
+			if secIP.IPAddress.Equal(group.ElasticIP) {
+				nicAddressID = secIP.ID
+				break
+			}
+		}
+	}
+
+	if nicAddressID == nil {
+		Logger.Warning("vm %s doesn't hold the ipaddress %s", vmID, group.ElasticIP)
+		return fmt.Errorf("vm %s doesn't hold the ipaddress %s", vmID, group.ElasticIP)
+	}
+
+	failover := group.newFailover("release", nicID)
+	req := &egoscale.RemoveIPFromNic{ID: nicAddressID}
+	if err := engine.booleanRequest(req, engine.nicHolds(vmID, nicID, group.ElasticIP, false)); err != nil {
+		Logger.Crit("could not remove ip from nic %s (%s, term %d): %s", nicID, nicAddressID, group.term(), err)
+		return err
+	}
+	failover.Completed = time.Now()
+
+	failover.Visible, err = group.verifyNic(vmID, nicID, false)
+	group.recordFailover(failover)
+	if err != nil {
+		return err
+	}
+
+	Logger.Info("released ip %s from nic %s (term %d)", group.ElasticIP.String(), nicID, group.term())
+	return nil
+}
+
+// UpdateNic checks if the EIP must be reattached to self
+//
+// A master of an outdated term doesn't touch anything. Like every operation
+// on the EIP, it is run with the state lock held.
+func (group *Group) UpdateNic() error {
+	if err := group.checkTerm(); err != nil {
+		return err
+	}
+
+	nic, err := group.engine.fetchMyNic()
+	if err != nil {
+		return err
+	}
+
+	return group.updateNic(nic)
+}
+
+// updateNic reattaches or releases the EIP given the state of our NIC
+func (group *Group) updateNic(nic *egoscale.Nic) error {
+	engine := group.engine
+
+	found := false
+	for _, secIP := range nic.SecondaryIP {
+		if secIP.IPAddress.Equal(group.ElasticIP) {
+			// we still hold the EIP
+			found = true
+			break
+		}
+	}
+
+	// disassociate the IP from self if still present and backup or faulty
+	if (group.State == StateBackup || group.State == StateFault) && found {
+		Logger.Warning("state is %s but the eip %s was found, release", group.State, group.ElasticIP)
+		return group.ReleaseNic(*engine.VirtualMachineID, *engine.NicID)
+	}
+
+	// associate the IP to self if missing and Master
+	if group.State == StateMaster && !found {
+		Logger.Warning("state is %s but the eip %s was missing, obtain", group.State, group.ElasticIP)
+		return group.ObtainNic(*engine.NicID)
+	}
+
+	return nil
+}
+
+// updatePeers synchronizes the peers with the virtual machines found
+func (group *Group) updatePeers(vms map[string]*egoscale.VirtualMachine) error {
+	engine := group.engine
+
+	// grab the right to alter the Peers
+	group.peersMu.Lock()
+	defer group.peersMu.Unlock()
+
+	for key, vm := range vms {
+		if _, ok := group.peers[key]; ok {
+			continue
+		}
+
+		// add peer
+		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", key, engine.listenPort))
+		if err != nil {
+			Logger.Warning("%s", err)
+			return err
+		}
+
+		Logger.Info("found new peer %s (vm: %s, group: %d)", key, vm.ID, group.ID)
+		nic := vm.DefaultNic()
+		if nic == nil {
+			Logger.Warning("no default nic found for %q", vm.ID)
+		} else {
+			group.peers[key] = NewPeer(engine.peerConn(addr), addr, *vm.ID, *nic.ID)
+		}
+	}
+
+	// Remove extra peers from list of known peers
+	for key := range group.peers {
+		if _, ok := vms[key]; !ok {
+			Logger.Info("removing peer %s (group: %d)", key, group.ID)
+			delete(group.peers, key)
+		}
+	}
+
+	return nil
+}
+
+// UpdatePeer update the state of the given peer
+func (group *Group) UpdatePeer(addr net.UDPAddr, payload *Payload) {
+	if !group.ElasticIP.Equal(payload.IP) {
+		Logger.Warning("peer %s sent message for wrong EIP in group %d, got %s", addr.IP, group.ID, payload.IP.String())
+		return
+	}
+
+	group.peersMu.Lock()
+	defer group.peersMu.Unlock()
+	if peer, ok := group.peers[addr.IP.String()]; ok {
+		legacy := payload.Version == LegacyProtoVersion
+		if legacy && !group.legacy {
+			if !peer.Legacy {
+				Logger.Warning("group %d: peer %s speaks protocol %s, which cannot carry ip %s", group.ID, addr.IP, payload.Version, group.ElasticIP)
+				peer.Legacy = true
+			}
+			return
+		}
+		if legacy != peer.Legacy {
+			Logger.Info("peer %s speaks protocol %s", addr.IP, payload.Version)
+			peer.Legacy = legacy
+		}
+
+		// the legacy payloads carry no freshness information
+		if !legacy {
+			if err := peer.CheckFreshness(payload); err != nil {
+				peer.Replays++
+				Logger.Info("peer %s sent a stale payload: %s", addr.IP, err)
+				return
+			}
+
+			if payload.ConfigHash != group.configHash && payload.ConfigHash != peer.ConfigHash {
+				Logger.Warning("peer %s (%s) configuration differs from ours in group %d", addr.IP, payload.Hostname, group.ID)
+			}
+
+			peer.Term = payload.Term
+			if group.observeTerm(payload.Term) && group.state() == StateMaster {
+				Logger.Warning("group %d: peer %s (%s) knows the term %d, newer than ours (%d), stepping down",
+					group.ID, addr.IP, payload.Hostname, payload.Term, group.masterTerm)
+				group.engine.TriggerCheck()
+			}
+
+			if payload.Resign {
+				group.resignPeer(peer)
+				return
+			}
+		}
+
+		peer.Priority = payload.Priority
+		peer.NicID = payload.NicID
+		group.checkSamePriority(peer)
+		peer.State = payload.State
+		peer.Interval = payload.Interval
+		peer.ConfigHash = payload.ConfigHash
+		peer.Hostname = payload.Hostname
+		peer.Features = payload.Features
+		peer.Resigned = false
+		peer.DeadPeers = payload.DeadPeers
+		peer.LastSeen = time.Now()
+		group.checkDualMaster(peer)
+		return
+	}
+
+	Logger.Warning("peer %s not found in configuration", addr.IP.String())
+}
+
+// resignPeer considers the peer dead as it is shutting down
+//
+// The peer releases the EIP by itself, so unlike a peer that stopped
+// advertising, there is no need to release it. A new master is elected
+// right away.
+func (group *Group) resignPeer(peer *Peer) {
+	if peer.Resigned {
+		return
+	}
+
+	Logger.Info("peer %s resigned from group %d, considering dead.", peer.UDPAddr.IP, group.ID)
+	// its lease has been released, no need to wait for it to expire
+	group.forgetLease()
+	peer.Resigned = true
+	peer.Dead = true
+	peer.dualMaster = false
+	group.engine.TriggerCheck()
+}
+
+// checkDualMaster detects that the peer and ourself both claim to be master
+//
+// Each episode is logged and counted once, and the state is checked right
+// away so that the master with the worst advertisement steps down without
+// waiting for the next tick.
+func (group *Group) checkDualMaster(peer *Peer) {
+	if peer.State != StateMaster || group.state() != StateMaster {
+		peer.dualMaster = false
+		return
+	}
+
+	if peer.dualMaster {
+		return
+	}
+
+	peer.dualMaster = true
+	group.DualMasters++
+	Logger.Warning("group %d: peer %s (priority %d) is master as well (priority %d), dual master #%d",
+		group.ID, peer.UDPAddr.IP, peer.Priority, group.advertisedPriority(), group.DualMasters)
+
+	group.engine.TriggerCheck()
+}
+
+// checkSamePriority warns once when the peer shares our priority
+//
+// Both nodes then rely on the tie-break of BackupOf, which is most likely
+// not what the operator meant.
+func (group *Group) checkSamePriority(peer *Peer) {
+	priority := group.advertisedPriority()
+	if peer.Priority != priority || peer.Features&FeatureWitness != 0 || group.engine.Witness {
+		peer.samePriority = false
+		return
+	}
+
+	if peer.samePriority {
+		return
+	}
+
+	peer.samePriority = true
+	winner := "we win"
+	if group.peerWinsTie(peer) {
+		winner = "the peer wins"
+	}
+	Logger.Warning("group %d: peer %s (nic %s) has our priority %d, the lowest nic id is preferred (%s)",
+		group.ID, peer.UDPAddr.IP, peer.NicID, priority, winner)
+}
+
+// PeerIsNewlyDead contains the logic to say if the peer is considered dead
+func (group *Group) PeerIsNewlyDead(now time.Time, peer *Peer) bool {
+	engine := group.engine
+
+	peerDiff := now.Sub(peer.LastSeen)
+	dead := peer.Resigned || peerDiff > engine.DeadTime
+	if !dead && peer.Dead {
+		switch {
+		case now.Before(peer.QuarantinedUntil):
+			dead = true
+		case !peer.QuarantinedUntil.IsZero():
+			Logger.Info("peer %s is out of quarantine.", peer.UDPAddr.IP)
+			peer.QuarantinedUntil = time.Time{}
+		case !peer.AliveSince.IsZero():
+			// it was alive before, count the flap
+			group.recordPeerFlap(now, peer)
+			dead = now.Before(peer.QuarantinedUntil)
+		}
+	}
+
+	if dead != peer.Dead {
+		if dead {
+			Logger.Info("peer %s last seen %s (%dms ago), considering dead.", peer.UDPAddr.IP, peer.LastSeen.Format(time.RFC3339), peerDiff/time.Millisecond)
+		} else {
+			Logger.Info("peer %s, is now back alive.", peer.UDPAddr.IP)
+			peer.AliveSince = now
+			peer.fencePending = false
+		}
+		peer.Dead = dead
+		return dead
+	}
+	return false
+}
+
+// advertisedPriority returns our priority, worsened by the failing trackers
+// and the flap penalty
+func (group *Group) advertisedPriority() byte {
+	penalty, _ := group.engine.health()
+	penalty += int(group.flapPenalty(time.Now()))
+	if priority := int(group.priority) + penalty; priority < 255 {
+		return byte(priority)
+	}
+	return 255
+}
+
+// BackupOf tells if we are a backup of the given peer
+//
+// When both share the same priority, the lowest NIC ID wins.
+func (group *Group) BackupOf(peer *Peer) bool {
+	if peer.Dead {
+		return false
+	}
+
+	priority := group.advertisedPriority()
+	if peer.Priority != priority {
+		return peer.Priority < priority
+	}
+
+	return group.peerWinsTie(peer)
+}
+
+// yieldsTo tells if the peer should hold the EIP rather than us
+//
+// When only one of us is master, it keeps the EIP if preemption is disabled,
+// or while the other one hasn't been alive for the preempt delay yet.
+// Otherwise, the best advertisement wins. The legacy peers don't advertise
+// their state and can always preempt.
+func (group *Group) yieldsTo(now time.Time, peer *Peer) bool {
+	if peer.Dead || peer.State == StateFault || peer.State == StateStopping || peer.Features&FeatureWitness != 0 {
+		return false
+	}
+
+	peerMaster := peer.State == StateMaster
+	if peer.State != StateUnknown && peerMaster != (group.State == StateMaster) {
+		if group.noPreempt || now.Sub(peer.AliveSince) < group.preemptDelay {
+			return peerMaster
+		}
+	}
+
+	return group.BackupOf(peer)
+}
+
+// majority is the number of votes needed to agree, ours included
+//
+// The peers that never advertised, e.g. a monitor, don't count.
+func (group *Group) majority() int {
+	return group.majorityOf(func(peer *Peer) bool {
+		return !peer.LastSeen.IsZero()
+	})
+}
+
+// majorityOf is the majority of the voters, ourself included
+func (group *Group) majorityOf(votes func(peer *Peer) bool) int {
+	voters := 1
+	for _, peer := range group.peers {
+		if votes(peer) {
+			voters++
+		}
+	}
+
+	return voters/2 + 1
+}
+
+// deathConfirmed tells if enough peers agree that the peer is dead
+//
+// In quorum mode, the peers that consider it dead, as advertised, and
+// ourself must form a majority of the group. A peer that resigned is
+// known to be dead.
+func (group *Group) deathConfirmed(peer *Peer) bool {
+	if !group.quorum || peer.Resigned {
+		return true
+	}
+
+	return group.deathVotes(peer) >= group.majority()
+}
+
+// deathVotes counts the peers that consider the peer dead, ourself included
+func (group *Group) deathVotes(peer *Peer) int {
+	votes := 1
+	for _, other := range group.peers {
+		if other == peer || other.Dead {
+			continue
+		}
+
+		for _, nicID := range other.DeadPeers {
+			if nicID.Equal(*peer.NicID) {
+				votes++
+				break
+			}
+		}
+	}
+
+	return votes
+}
+
+// peerWinsTie tells if the peer wins over us given an equal priority
+//
+// Both sides know each other's NIC ID so they reach the same conclusion.
+func (group *Group) peerWinsTie(peer *Peer) bool {
+	return bytes.Compare(peer.NicID.UUID[:], group.engine.NicID.UUID[:]) < 0
+}
+
+// PerformStateTransition transition to the given state
+//
+// The transition must be allowed by the state machine, the reason is
+// logged along with it. Becoming backup or master obtains or releases the
+// EIP and the transition is undone if it fails. Entering the fault state
+// attempts to release the EIP but never fails.
+//
+// The notify scripts are run after the transition or, following the abort
+// policy, before it so that their failure cancels it.
+//
+// The state lock is taken, which serializes the transitions with the other
+// operations on the EIP, e.g. the reconciliation.
+func (group *Group) PerformStateTransition(state State, reason string) error {
+	group.stateMu.Lock()
+	defer group.stateMu.Unlock()
+
+	return group.transition(state, reason)
+}
+
+// transition performs the state transition, the state lock being held
+func (group *Group) transition(state State, reason string) error {
+	if group.State == state {
+		return nil
+	}
+
+	if !group.State.CanTransitionTo(state) {
+		return fmt.Errorf("group %d: illegal transition from %s to %s (%s)", group.ID, group.State, state, reason)
+	}
+
+	Logger.Info("switching state of group %d from %s to %s: %s", group.ID, group.State, state, reason)
+
+	oldState := group.State
+	abortable := state == StateBackup || state == StateMaster
+	if group.engine.Notify.Policy == NotifyAbort {
+		if err := group.notify(oldState, state, reason); err != nil && abortable {
+			return fmt.Errorf("group %d: transition to %s aborted: %s", group.ID, state, err)
+		}
+	}
+
+	group.setState(state)
+	group.detected(time.Now())
+
+	// the new term is only advertised once the EIP is ours, so that a failed
+	// takeover doesn't make the current master stale
+	oldTerm := group.masterTerm
+	if state == StateMaster {
+		group.masterTerm = group.term() + 1
+		Logger.Info("group %d: taking over in term %d", group.ID, group.masterTerm)
+
+		if group.engine.LeaseDuration > 0 {
+			if err := group.acquireLease(group.masterTerm); err != nil {
+				group.setState(oldState)
+				group.masterTerm = oldTerm
+				return fmt.Errorf("group %d: %s", group.ID, err)
+			}
+		}
+	}
+
+	if oldState == StateMaster && group.engine.LeaseDuration > 0 {
+		if err := group.releaseLease(); err != nil {
+			Logger.Warning("group %d: %s", group.ID, err)
+		}
+	}
+
+	if state != StateInit && state != StateStopping {
+		if err := group.UpdateNic(); err != nil {
+			if abortable {
+				if state == StateMaster && group.engine.LeaseDuration > 0 {
+					if err := group.releaseLease(); err != nil {
+						Logger.Warning("group %d: %s", group.ID, err)
+					}
+				}
+				group.setState(oldState)
+				group.masterTerm = oldTerm
+				return err
+			}
+			Logger.Warning("group %d: could not release the eip: %s", group.ID, err)
+		}
+	}
+
+	if state == StateMaster {
+		group.observeTerm(group.masterTerm)
+	}
+
+	group.recordTransition(time.Now(), oldState, state)
+
+	if group.engine.Notify.Policy != NotifyAbort {
+		group.notify(oldState, state, reason) // nolint: errcheck, gosec
+	}
+
+	return nil
+}
+
+// election is the outcome of looking at the peers
+type election struct {
+	state  State
+	reason string
+	// deadPeers are the peers to release from the EIP
+	deadPeers []deadPeer
+	// masterPeer tells if an alive peer claims to be master
+	masterPeer bool
+}
+
+// deadPeer is a dead peer as seen by the election
+//
+// It is copied under the peers lock, so that it can be released and fenced
+// without holding it.
+type deadPeer struct {
+	peer     *Peer
+	ip       net.IP
+	vmID     *egoscale.UUID
+	nicID    *egoscale.UUID
+	lastSeen time.Time
+	resigned bool
+	witness  bool
+	// votes is how many consider it dead, ourself included
+	votes int
+	// majority is how many votes are needed to fence it
+	majority int
+}
+
+// elect looks at the peers to decide whether we should be master
+//
+// The dead peers are released from the EIP, once, as soon as their death is
+// confirmed. In quorum mode, we also wait for the death of the master to be
+// confirmed before taking over.
+func (group *Group) elect(now time.Time) election {
+	deadPeers := make([]deadPeer, 0)
+	bestAdvertisement := true
+	masterPeer := false
+	reason := "best advertisement"
+
+	group.peersMu.Lock()
+	defer group.peersMu.Unlock()
+
+	for _, peer := range group.peers {
+		if group.PeerIsNewlyDead(now, peer) {
+			peer.fencePending = true
+		}
+
+		if !peer.Dead {
+			if peer.State == StateMaster && peer.Features&FeatureWitness == 0 {
+				masterPeer = true
+			}
+			if group.yieldsTo(now, peer) {
+				bestAdvertisement = false
+				reason = fmt.Sprintf("peer %s takes precedence", peer.UDPAddr.IP)
+			}
+			continue
+		}
+
+		confirmed := group.deathConfirmed(peer)
+		if peer.fencePending && confirmed {
+			deadPeers = append(deadPeers, deadPeer{
+				peer:     peer,
+				ip:       peer.UDPAddr.IP,
+				vmID:     peer.VirtualMachineID,
+				nicID:    peer.NicID,
+				lastSeen: peer.LastSeen,
+				resigned: peer.Resigned,
+				witness:  peer.Features&FeatureWitness != 0,
+				votes:    group.deathVotes(peer),
+				majority: group.fenceMajority(),
+			})
+		}
+
+		wasMaster := peer.State == StateMaster || (peer.State == StateUnknown && peer.Priority < group.advertisedPriority())
+		if wasMaster && !confirmed && group.State != StateMaster {
+			bestAdvertisement = false
+			reason = fmt.Sprintf("waiting for a quorum to confirm that peer %s is dead", peer.UDPAddr.IP)
+		}
+	}
+
+	state := StateMaster
+	if !bestAdvertisement {
+		state = StateBackup
+	}
+
+	return election{state: state, reason: reason, deadPeers: deadPeers, masterPeer: masterPeer}
+}
+
+// CheckState updates the states of our peers
+//
+// The peers are only locked while the election takes place: obtaining or
+// releasing the EIP and running the notify scripts take time, during which
+// the advertisements must go on.
+func (group *Group) CheckState(now time.Time) {
+	group.stateMu.Lock()
+	defer group.stateMu.Unlock()
+
+	elected := group.elect(now)
+	state, reason, deadPeers := elected.state, elected.reason, elected.deadPeers
+
+	// a new master stays so for a while, even if a better peer shows up, but
+	// a dual master is resolved right away
+	if hold := group.holdsMaster(now); state == StateBackup && hold > 0 && !elected.masterPeer {
+		if !group.holding {
+			Logger.Info("group %d: %s, staying master for %s more", group.ID, reason, hold.Round(time.Millisecond))
+			group.holding = true
+		}
+		state = StateMaster
+	} else {
+		group.holding = false
+	}
+
+	// someone took over while we weren't looking, step down before anything
+	if group.stale() {
+		state, reason = StateBackup, fmt.Sprintf("term %d is newer than ours (%d)", group.term(), group.masterTerm)
+	}
+
+	// a witness only takes part in the votes
+	if group.engine.Witness {
+		state, reason = StateBackup, "witness"
+	}
+
+	if group.engine.LeaseDuration > 0 && state == StateMaster {
+		// the lease of the previous master has to expire before taking over
+		if group.State != StateMaster {
+			if held, why := group.leaseHeldByOther(now); held {
+				state, reason = StateBackup, why
+			}
+		} else if group.leaseExpired(now) {
+			state, reason = StateBackup, "the lease could not be renewed"
+		}
+	}
+
+	// a failing tracker without weight forbids holding the EIP
+	if _, fault := group.engine.health(); fault != "" {
+		state, reason = StateFault, fault
+	}
+
+	// without the API, the EIP can neither be obtained nor released
+	if down, why := group.engine.apiDown(); down {
+		state, reason = StateFault, why
+	}
+
+	// when cut off, the peers are most likely not dead: neither take over
+	// nor release them, but a master stays so
+	isolated, why := group.engine.isolated()
+	if state == StateMaster && group.State != StateMaster {
+		isolated, why = group.engine.isolatedNow()
+	}
+	if isolated && state == StateMaster && group.State != StateMaster {
+		state, reason = StateBackup, why
+	}
+
+	err := group.transition(state, reason)
+
+	if err != nil {
+		Logger.Crit("could not switch state. %s", err)
+		if err := group.transition(StateFault, err.Error()); err != nil {
+			Logger.Crit("%s", err)
+		}
+	}
+
+	// Disconnect the dead peers from their NIC
+	// and reobtain the Nic for ourself (split-brain)
+	if len(deadPeers) > 0 && group.State != StateFault && !group.engine.Witness && !isolated {
+		group.peersMu.Lock()
+		for _, dead := range deadPeers {
+			dead.peer.fencePending = false
+		}
+		group.peersMu.Unlock()
+
+		// the API calls are made without the peers lock, not to delay the advertisements
+		for _, dead := range deadPeers {
+			err := group.ReleaseNic(*dead.vmID, *dead.nicID)
+			if err != nil {
+				Logger.Crit("%s", err)
+			}
+
+			why := fmt.Sprintf("last seen %s", dead.lastSeen.Format(time.RFC3339))
+			if err := group.fence(dead, why); err != nil {
+				Logger.Warning("%s", err)
+			}
+		}
+
+		if err := group.UpdateNic(); err != nil {
+			Logger.Crit("%s", err)
+		}
+	}
+
+	// a later operation fixes a drift, not this transition
+	group.detected(time.Time{})
+}
+
+// state returns the current state without the state lock
+//
+// The state lock is held during the API calls, which must delay neither
+// the advertisements nor the handling of those of the peers.
+func (group *Group) state() State {
+	return State(atomic.LoadInt32(&group.stateValue))
+}
+
+// setState changes the state, the state lock being held
+func (group *Group) setState(state State) {
+	group.State = state
+	atomic.StoreInt32(&group.stateValue, int32(state))
+}
+
+// term returns the newest term known in the group
+func (group *Group) term() uint64 {
+	return atomic.LoadUint64(&group.Term)
+}
+
+// observeTerm records the term advertised by a peer
+//
+// It returns whether the term is newer than any we knew of.
+func (group *Group) observeTerm(term uint64) bool {
+	for {
+		current := group.term()
+		if term <= current {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&group.Term, current, term) {
+			return true
+		}
+	}
+}
+
+// stale tells if we are the master of an outdated term
+//
+// A newer term means that a peer took over while we were not listening,
+// e.g. our VM was frozen, so our view of the group can't be trusted.
+func (group *Group) stale() bool {
+	return group.State == StateMaster && group.masterTerm < group.term()
+}
+
+// checkTerm refuses to act upon the EIP with an outdated view
+func (group *Group) checkTerm() error {
+	if group.stale() {
+		return fmt.Errorf("group %d: master of term %d while term %d is known, refusing to touch the eip",
+			group.ID, group.masterTerm, group.term())
+	}
+	return nil
+}
+
+// LowerPriority lowers the priority value (making it more important)
+func (group *Group) LowerPriority() (byte, error) {
+	if group.priority > 1 {
+		group.priority--
+		return group.priority, nil
+	}
+	return group.priority, fmt.Errorf("priority cannot be lowered any more")
+}
+
+// RaisePriority raises the priority value (making it less important)
+func (group *Group) RaisePriority() (byte, error) {
+	if group.priority < 255 {
+		group.priority++
+		return group.priority, nil
+	}
+	return group.priority, fmt.Errorf("priority cannot be raised any more")
+}
@@ -0,0 +1,213 @@
+package exoip
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+func TestParseGroupConfig(t *testing.T) {
+	tests := []struct {
+		definition string
+		id         byte
+		ip         string
+		priority   int
+	}{
+		{"1=192.0.2.1", 1, "192.0.2.1", 10},
+		{"2=192.0.2.2@20", 2, "192.0.2.2", 20},
+		{"255=2001:db8::1", 255, "2001:db8::1", 10},
+		{"3=2001:db8::1@0", 3, "2001:db8::1", 0},
+	}
+
+	for _, tt := range tests {
+		config, err := ParseGroupConfig(tt.definition, 10)
+		if err != nil {
+			t.Errorf("%s: %s", tt.definition, err)
+			continue
+		}
+		if config.ID != tt.id || !config.ElasticIP.Equal(net.ParseIP(tt.ip)) || config.Priority != tt.priority {
+			t.Errorf("%s: got %d=%s@%d, want %d=%s@%d", tt.definition,
+				config.ID, config.ElasticIP, config.Priority, tt.id, tt.ip, tt.priority)
+		}
+	}
+}
+
+func TestParseGroupConfigErrors(t *testing.T) {
+	for _, definition := range []string{
+		"192.0.2.1",
+		"0=192.0.2.1",
+		"256=192.0.2.1",
+		"a=192.0.2.1",
+		"1=192.0.2.1@",
+		"1=192.0.2.1@x",
+		"1=192.0.2.1@256",
+		"1=192.0.2.1@-1",
+		"1=192.0.2",
+		"1=",
+	} {
+		if config, err := ParseGroupConfig(definition, 10); err == nil {
+			t.Errorf("%s: got %+v, want an error", definition, config)
+		}
+	}
+}
+
+func testGroup(priority byte, nicID string) *Group {
+	engine := &Engine{NicID: egoscale.MustParseUUID(nicID)}
+	return &Group{
+		ID:       1,
+		State:    StateBackup,
+		priority: priority,
+		peers:    make(map[string]*Peer),
+		engine:   engine,
+	}
+}
+
+func testPeer(priority byte, nicID string, state State) *Peer {
+	return &Peer{
+		UDPAddr:  &net.UDPAddr{IP: net.ParseIP("192.0.2.2")},
+		NicID:    egoscale.MustParseUUID(nicID),
+		Priority: priority,
+		State:    state,
+	}
+}
+
+func TestBackupOfSamePriority(t *testing.T) {
+	low := "00000000-0000-0000-0000-000000000001"
+	high := "00000000-0000-0000-0000-000000000002"
+
+	tests := []struct {
+		name     string
+		priority byte
+		ours     string
+		theirs   string
+		backup   bool
+	}{
+		{"better priority", 5, high, low, false},
+		{"worse priority", 20, low, high, true},
+		{"same priority, lower nic id", 10, low, high, false},
+		{"same priority, higher nic id", 10, high, low, true},
+	}
+
+	for _, tt := range tests {
+		group := testGroup(tt.priority, tt.ours)
+		peer := testPeer(10, tt.theirs, StateBackup)
+		if backup := group.BackupOf(peer); backup != tt.backup {
+			t.Errorf("%s: got backup %v, want %v", tt.name, backup, tt.backup)
+		}
+	}
+}
+
+func TestYieldsTo(t *testing.T) {
+	ours := "00000000-0000-0000-0000-000000000002"
+	theirs := "00000000-0000-0000-0000-000000000001"
+	now := time.Now()
+
+	tests := []struct {
+		name         string
+		state        State
+		noPreempt    bool
+		preemptDelay time.Duration
+		priority     byte
+		peerState    State
+		aliveSince   time.Duration
+		dead         bool
+		witness      bool
+		yields       bool
+	}{
+		{name: "better backup", state: StateBackup, priority: 5, peerState: StateBackup, yields: true},
+		{name: "worse backup", state: StateBackup, priority: 20, peerState: StateBackup},
+		{name: "dead peer", state: StateBackup, priority: 5, peerState: StateMaster, dead: true},
+		{name: "faulty peer", state: StateBackup, priority: 5, peerState: StateFault},
+		{name: "witness", state: StateBackup, priority: 5, peerState: StateBackup, witness: true},
+		{name: "better backup of a master", state: StateMaster, priority: 5, peerState: StateBackup, yields: true},
+		{name: "better backup, no preemption", state: StateMaster, noPreempt: true, priority: 5, peerState: StateBackup},
+		{name: "worse master, no preemption", state: StateBackup, noPreempt: true, priority: 20, peerState: StateMaster, yields: true},
+		{name: "better backup, preempt delay", state: StateMaster, preemptDelay: time.Minute, priority: 5, peerState: StateBackup, aliveSince: time.Second},
+		{name: "better backup, preempt delay over", state: StateMaster, preemptDelay: time.Minute, priority: 5, peerState: StateBackup, aliveSince: 2 * time.Minute, yields: true},
+		{name: "better legacy peer, no preemption", state: StateMaster, noPreempt: true, priority: 5, peerState: StateUnknown, yields: true},
+	}
+
+	for _, tt := range tests {
+		group := testGroup(10, ours)
+		group.State = tt.state
+		group.noPreempt = tt.noPreempt
+		group.preemptDelay = tt.preemptDelay
+
+		peer := testPeer(tt.priority, theirs, tt.peerState)
+		peer.Dead = tt.dead
+		peer.AliveSince = now.Add(-tt.aliveSince)
+		if tt.witness {
+			peer.Features = FeatureWitness
+		}
+
+		if yields := group.yieldsTo(now, peer); yields != tt.yields {
+			t.Errorf("%s: got yields %v, want %v", tt.name, yields, tt.yields)
+		}
+	}
+}
+
+func TestNewGroupLegacy(t *testing.T) {
+	tests := []struct {
+		ip     string
+		legacy bool
+	}{
+		{"192.0.2.1", true},
+		{"::ffff:192.0.2.1", true},
+		{"2001:db8::1", false},
+	}
+
+	for _, tt := range tests {
+		engine := &Engine{groups: make(map[byte]*Group)}
+		group, err := engine.newGroup(GroupConfig{ID: 1, ElasticIP: net.ParseIP(tt.ip)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group.legacy != tt.legacy {
+			t.Errorf("%s: got legacy %v, want %v", tt.ip, group.legacy, tt.legacy)
+		}
+	}
+}
+
+func TestDeathConfirmedWithMonitor(t *testing.T) {
+	ours := "00000000-0000-0000-0000-000000000001"
+	master := "00000000-0000-0000-0000-000000000002"
+	backup := "00000000-0000-0000-0000-000000000003"
+	monitor := "00000000-0000-0000-0000-000000000004"
+	now := time.Now()
+
+	group := testGroup(10, ours)
+	group.quorum = true
+
+	dead := testPeer(5, master, StateMaster)
+	dead.LastSeen = now.Add(-time.Minute)
+	dead.Dead = true
+
+	other := testPeer(20, backup, StateBackup)
+	other.LastSeen = now
+	other.DeadPeers = []*egoscale.UUID{dead.NicID}
+
+	// a monitor never advertises, hence always looks dead
+	silent := testPeer(30, monitor, StateUnknown)
+	silent.Dead = true
+
+	group.peers[master] = dead
+	group.peers[backup] = other
+	group.peers[monitor] = silent
+
+	if majority := group.majority(); majority != 2 {
+		t.Errorf("got majority %d, want 2", majority)
+	}
+	if !group.deathConfirmed(dead) {
+		t.Error("death of the master not confirmed by the backup and us")
+	}
+
+	other.Features = FeatureWitness
+	if majority := group.fenceMajority(); majority != 2 {
+		t.Errorf("got fence majority %d, want 2", majority)
+	}
+	if majority := group.majority(); majority != 2 {
+		t.Errorf("got majority %d with a witness, want 2", majority)
+	}
+}
@@ -0,0 +1,123 @@
+package exoip
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// InterfaceConfig describes a network interface to track
+type InterfaceConfig struct {
+	Name   string
+	Weight int
+}
+
+// ParseInterfaceConfig parses an interface definition of the form NAME[@WEIGHT]
+//
+// Without weight, the failure of the interface puts the groups in the
+// fault state.
+func ParseInterfaceConfig(definition string) (InterfaceConfig, error) {
+	config := InterfaceConfig{Name: definition}
+
+	if i := strings.LastIndex(definition, "@"); i >= 0 {
+		weight, err := strconv.Atoi(definition[i+1:])
+		if err != nil || weight < 0 || weight > 255 {
+			return config, fmt.Errorf("interface %q: invalid weight (must be 0-255)", definition)
+		}
+		config.Name, config.Weight = definition[:i], weight
+	}
+
+	if config.Name == "" {
+		return config, fmt.Errorf("interface %q: missing name (NAME[@WEIGHT])", definition)
+	}
+
+	return config, nil
+}
+
+// TrackInterface follows the link and the addresses of the interface
+//
+// The link and address updates are received from netlink. The interface
+// is failing when its link is down or when it has no global unicast
+// address left.
+func (engine *Engine) TrackInterface(config InterfaceConfig) error {
+	link, err := netlink.LinkByName(config.Name)
+	if err != nil {
+		return fmt.Errorf("interface %s: %s", config.Name, err)
+	}
+	index := link.Attrs().Index
+
+	links := make(chan netlink.LinkUpdate)
+	addrs := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		return fmt.Errorf("interface %s: %s", config.Name, err)
+	}
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		close(done)
+		return fmt.Errorf("interface %s: %s", config.Name, err)
+	}
+
+	tracker := engine.NewTracker(fmt.Sprintf("interface %s", config.Name), 1, 1, config.Weight)
+	tracker.Report(interfaceHealth(index))
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case update, ok := <-links:
+				if !ok {
+					Logger.Crit("interface %s: lost the link updates", config.Name)
+					tracker.Report(false, "lost the link updates")
+					return
+				}
+				if int(update.Index) != index {
+					continue
+				}
+			case update, ok := <-addrs:
+				if !ok {
+					Logger.Crit("interface %s: lost the address updates", config.Name)
+					tracker.Report(false, "lost the address updates")
+					return
+				}
+				if update.LinkIndex != index {
+					continue
+				}
+			}
+
+			tracker.Report(interfaceHealth(index))
+		}
+	}()
+
+	return nil
+}
+
+// interfaceHealth tells if the interface is up and has an address
+func interfaceHealth(index int) (bool, string) {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return false, "link is administratively down"
+	}
+	if attrs.OperState != netlink.OperUp && attrs.OperState != netlink.OperUnknown {
+		return false, fmt.Sprintf("link is %s", attrs.OperState)
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err.Error()
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			return true, ""
+		}
+	}
+
+	return false, "no address left"
+}
@@ -0,0 +1,162 @@
+package exoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// isolationTimeout is the longest time given to a reference to answer
+const isolationTimeout = time.Second
+
+// Number of probes in a row needed to become isolated, or not anymore
+const (
+	isolationFall = 3
+	isolationRise = 2
+)
+
+// isolationCheck tells if we can still reach the outside world
+type isolationCheck struct {
+	references []string
+	timeout    time.Duration
+	mu         sync.Mutex
+	isolated   bool
+	streak     int
+	detail     string
+}
+
+// StartIsolationCheck probes the references in the background every interval
+//
+// The references are IP[:PORT], the port defaults to 80. Without any, the
+// default gateway, which hosts the metadata server, is used. We are isolated
+// after a few probes in a row where none of the references answers, in which
+// case we never take the EIP over nor release it from the dead peers. As it
+// may take longer than the dead time, the references are also probed right
+// before taking over.
+func (engine *Engine) StartIsolationCheck(references []string) error {
+	if len(references) == 0 {
+		gateway, err := FindMetadataServer()
+		if err != nil {
+			return fmt.Errorf("isolation check: %s", err)
+		}
+		references = []string{gateway}
+	}
+
+	timeout := engine.Interval
+	if timeout > isolationTimeout {
+		timeout = isolationTimeout
+	}
+
+	check := &isolationCheck{timeout: timeout}
+	for _, reference := range references {
+		if _, _, err := net.SplitHostPort(reference); err != nil {
+			reference = net.JoinHostPort(strings.Trim(reference, "[]"), "80")
+		}
+		check.references = append(check.references, reference)
+	}
+	engine.isolation = check
+
+	go func() {
+		for {
+			start := time.Now()
+			check.probe()
+			time.Sleep(engine.Interval - time.Since(start))
+		}
+	}()
+
+	return nil
+}
+
+// reach tries the references until one of them answers
+//
+// A refused connection is an answer: the reference is reachable.
+func (check *isolationCheck) reach() error {
+	var lastErr error
+	for _, reference := range check.references {
+		conn, err := net.DialTimeout("tcp", reference, check.timeout)
+		if err == nil {
+			conn.Close() // nolint: errcheck, gosec
+		}
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// probe tries the references, updating the status
+//
+// Like for the trackers, it takes isolationFall failed probes in a row to
+// become isolated and isolationRise successful ones to get back to normal.
+func (check *isolationCheck) probe() {
+	lastErr := check.reach()
+
+	check.mu.Lock()
+	defer check.mu.Unlock()
+
+	isolated := lastErr != nil
+	if isolated == check.isolated {
+		// the probe confirms the current status
+		check.streak = 0
+		if isolated {
+			check.detail = fmt.Sprintf("isolated: %s", lastErr)
+		}
+		return
+	}
+
+	check.streak++
+	threshold := isolationFall
+	if check.isolated {
+		threshold = isolationRise
+	}
+	if check.streak < threshold {
+		return
+	}
+
+	check.isolated = isolated
+	check.streak = 0
+	if isolated {
+		check.detail = fmt.Sprintf("isolated: %s", lastErr)
+		Logger.Warning("isolated: none of %s answered %d times in a row, last error: %s",
+			strings.Join(check.references, ", "), isolationFall, lastErr)
+	} else {
+		Logger.Info("not isolated anymore")
+	}
+}
+
+// isolated tells if we are cut off from the outside world and why
+func (engine *Engine) isolated() (bool, string) {
+	check := engine.isolation
+	if check == nil {
+		return false, ""
+	}
+
+	check.mu.Lock()
+	defer check.mu.Unlock()
+
+	return check.isolated, check.detail
+}
+
+// isolatedNow tells if we are isolated, probing the references right away
+//
+// It is used before taking over: the status takes a few probes to change,
+// the dead peers may well be declared dead first.
+func (engine *Engine) isolatedNow() (bool, string) {
+	check := engine.isolation
+	if check == nil {
+		return false, ""
+	}
+
+	if isolated, why := engine.isolated(); isolated {
+		return true, why
+	}
+	if err := check.reach(); err != nil {
+		return true, fmt.Sprintf("isolated: %s", err)
+	}
+	return false, ""
+}
@@ -0,0 +1,39 @@
+package exoip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsolatedNow(t *testing.T) {
+	engine := &Engine{}
+	if isolated, _ := engine.isolatedNow(); isolated {
+		t.Error("isolated without any check")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference := listener.Addr().String()
+
+	engine.isolation = &isolationCheck{
+		references: []string{reference},
+		timeout:    time.Second,
+	}
+	if isolated, why := engine.isolatedNow(); isolated {
+		t.Errorf("isolated with a listening reference: %s", why)
+	}
+
+	// a refused connection is an answer
+	listener.Close() // nolint: errcheck, gosec
+	if isolated, why := engine.isolatedNow(); isolated {
+		t.Errorf("isolated with a closed reference: %s", why)
+	}
+
+	engine.isolation.isolated = true
+	if isolated, _ := engine.isolatedNow(); !isolated {
+		t.Error("not isolated while the probes fail")
+	}
+}
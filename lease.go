@@ -0,0 +1,282 @@
+package exoip
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+// Keys of the tags recording the lease on the EIP
+const (
+	leaseHolderKey = "exoip-holder"
+	leaseTermKey   = "exoip-term"
+	leaseExpiryKey = "exoip-expiry"
+)
+
+// lease is the right to hold the EIP, as recorded in its tags
+type lease struct {
+	Holder string
+	Term   uint64
+	Expiry time.Time
+	tags   []egoscale.ResourceTag
+}
+
+// free tells if the lease can be taken
+func (l *lease) free(now time.Time) bool {
+	return l.Holder == "" || now.After(l.Expiry)
+}
+
+// String returns a description of the lease, e.g. ID (term 3) until ...
+func (l *lease) String() string {
+	return fmt.Sprintf("%s (term %d) until %s", l.Holder, l.Term, l.Expiry.Format(time.RFC3339))
+}
+
+// readLease fetches the EIP and the lease recorded in its tags
+//
+// The lease is remembered, see leaseHeldByOther.
+func (group *Group) readLease() (*egoscale.UUID, *lease, error) {
+	resp, err := group.engine.get(group.leaseQuery())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not fetch ip %s: %s", group.ElasticIP, err)
+	}
+
+	ip := resp.(*egoscale.IPAddress)
+	l := parseLease(ip)
+
+	group.leaseMu.Lock()
+	group.lastLease = l
+	group.leaseMu.Unlock()
+
+	return ip.ID, l, nil
+}
+
+// forgetLease drops the lease last read, e.g. once its holder resigned
+func (group *Group) forgetLease() {
+	group.leaseMu.Lock()
+	defer group.leaseMu.Unlock()
+
+	group.lastLease = nil
+}
+
+// leaseQuery is the query of the EIP
+func (group *Group) leaseQuery() *egoscale.IPAddress {
+	return &egoscale.IPAddress{
+		IPAddress: group.ElasticIP,
+		IsElastic: true,
+		ZoneID:    group.engine.ZoneID,
+	}
+}
+
+// leaseIs returns the check of a mutation of the lease, done once the lease is as expected
+func (group *Group) leaseIs(expected func(l *lease) bool) applied {
+	return func(ctx context.Context) (bool, error) {
+		resp, err := group.engine.client.GetWithContext(ctx, group.leaseQuery())
+		if err != nil {
+			return false, err
+		}
+
+		return expected(parseLease(resp.(*egoscale.IPAddress))), nil
+	}
+}
+
+// parseLease reads the lease from the tags of the EIP
+func parseLease(ip *egoscale.IPAddress) *lease {
+	l := &lease{}
+	for _, tag := range ip.Tags {
+		switch tag.Key {
+		case leaseHolderKey:
+			l.Holder = tag.Value
+		case leaseTermKey:
+			l.Term, _ = strconv.ParseUint(tag.Value, 10, 64) // nolint: errcheck
+		case leaseExpiryKey:
+			l.Expiry, _ = time.Parse(time.RFC3339, tag.Value) // nolint: errcheck
+		default:
+			continue
+		}
+		l.tags = append(l.tags, tag)
+	}
+
+	return l
+}
+
+// acquireLease claims or renews the lease on the EIP for the given term
+//
+// The tags of the current lease are deleted, values included, before ours
+// are created: if another peer changed them in between, one of both calls
+// fails, which makes it a compare-and-set. The lease is then read back to
+// be sure. Finding the lease held by another peer, or with a newer term,
+// invalidates ours right away.
+func (group *Group) acquireLease(term uint64) error {
+	engine := group.engine
+	me := engine.VirtualMachineID.String()
+
+	id, current, err := group.readLease()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if current.Holder != me && !current.free(now) {
+		group.setLeaseExpiry(time.Time{})
+		return fmt.Errorf("the lease on ip %s is held by %s", group.ElasticIP, current)
+	}
+	if current.Term > term {
+		group.setLeaseExpiry(time.Time{})
+		group.observeTerm(current.Term)
+		return fmt.Errorf("the lease on ip %s has the newer term %d", group.ElasticIP, current.Term)
+	}
+
+	// a peer took over while we were reading
+	if known := group.term(); known > term {
+		group.setLeaseExpiry(time.Time{})
+		return fmt.Errorf("the term %d is newer than %d, not writing the lease on ip %s", known, term, group.ElasticIP)
+	}
+
+	resourceType := egoscale.IPAddress{}.ResourceType()
+	if len(current.tags) > 0 {
+		if err := engine.booleanRequest(&egoscale.DeleteTags{
+			ResourceIDs:  []egoscale.UUID{*id},
+			ResourceType: resourceType,
+			Tags:         current.tags,
+		}, group.leaseIs(func(l *lease) bool {
+			return len(l.tags) == 0
+		})); err != nil {
+			return fmt.Errorf("could not replace the lease %s: %s", current, err)
+		}
+	}
+
+	expiry := now.Add(engine.LeaseDuration).Truncate(time.Second)
+	if err := engine.booleanRequest(&egoscale.CreateTags{
+		ResourceIDs:  []egoscale.UUID{*id},
+		ResourceType: resourceType,
+		Tags: []egoscale.ResourceTag{
+			{Key: leaseHolderKey, Value: me},
+			{Key: leaseTermKey, Value: strconv.FormatUint(term, 10)},
+			{Key: leaseExpiryKey, Value: expiry.UTC().Format(time.RFC3339)},
+		},
+	}, group.leaseIs(func(l *lease) bool {
+		return l.Holder == me && l.Term == term && l.Expiry.Equal(expiry)
+	})); err != nil {
+		return fmt.Errorf("could not write the lease on ip %s: %s", group.ElasticIP, err)
+	}
+
+	_, written, err := group.readLease()
+	if err != nil {
+		return err
+	}
+	if written.Holder != me || written.Term != term {
+		group.setLeaseExpiry(time.Time{})
+		return fmt.Errorf("lost the lease on ip %s to %s", group.ElasticIP, written)
+	}
+
+	group.setLeaseExpiry(expiry)
+	Logger.Info("group %d: lease on ip %s held until %s (term %d)", group.ID, group.ElasticIP, expiry.Format(time.RFC3339), term)
+	return nil
+}
+
+// releaseLease removes our lease on the EIP, if we still hold it
+func (group *Group) releaseLease() error {
+	engine := group.engine
+	group.setLeaseExpiry(time.Time{})
+
+	id, current, err := group.readLease()
+	if err != nil {
+		return err
+	}
+	if current.Holder != engine.VirtualMachineID.String() {
+		return nil
+	}
+
+	if err := engine.booleanRequest(&egoscale.DeleteTags{
+		ResourceIDs:  []egoscale.UUID{*id},
+		ResourceType: egoscale.IPAddress{}.ResourceType(),
+		Tags:         current.tags,
+	}, group.leaseIs(func(l *lease) bool {
+		return l.Holder != current.Holder || l.Term != current.Term
+	})); err != nil {
+		return fmt.Errorf("could not release the lease %s: %s", current, err)
+	}
+
+	Logger.Info("group %d: released the lease on ip %s (term %d)", group.ID, group.ElasticIP, current.Term)
+	return nil
+}
+
+// leaseHeldByOther tells if another peer holds a valid lease on the EIP
+//
+// The lease last read is trusted until it is about to expire, the lease is
+// only read again then, as its holder may have renewed it.
+func (group *Group) leaseHeldByOther(now time.Time) (bool, string) {
+	me := group.engine.VirtualMachineID.String()
+
+	group.leaseMu.Lock()
+	last := group.lastLease
+	group.leaseMu.Unlock()
+
+	if last != nil && last.Holder != "" && last.Holder != me && now.Add(group.engine.Interval).Before(last.Expiry) {
+		return true, fmt.Sprintf("the lease is held by %s", last)
+	}
+
+	_, current, err := group.readLease()
+	if err != nil {
+		// acquiring the lease will fail as well
+		return false, ""
+	}
+
+	if current.Holder == me || current.free(now) {
+		return false, ""
+	}
+	return true, fmt.Sprintf("the lease is held by %s", current)
+}
+
+// setLeaseExpiry records until when our lease is valid
+func (group *Group) setLeaseExpiry(expiry time.Time) {
+	group.leaseMu.Lock()
+	defer group.leaseMu.Unlock()
+
+	group.leaseExpiry = expiry
+}
+
+// leaseExpired tells if we are not entitled to hold the EIP anymore
+func (group *Group) leaseExpired(now time.Time) bool {
+	if group.engine.LeaseDuration == 0 {
+		return false
+	}
+
+	group.leaseMu.Lock()
+	defer group.leaseMu.Unlock()
+
+	return now.After(group.leaseExpiry)
+}
+
+// RenewLeases renews the leases of the groups we are master of
+//
+// When a lease cannot be renewed, the states are checked right away.
+func (engine *Engine) RenewLeases() {
+	for _, group := range engine.Groups() {
+		if err := group.renewLease(); err != nil {
+			Logger.Crit("group %d: could not renew the lease: %s", group.ID, err)
+			engine.TriggerCheck()
+		}
+	}
+}
+
+// renewLease renews our lease if we are still the master of the newest term
+//
+// The state lock is held, so that we cannot step down meanwhile and have
+// the lease written back once released.
+func (group *Group) renewLease() error {
+	group.stateMu.Lock()
+	defer group.stateMu.Unlock()
+
+	if group.State != StateMaster {
+		return nil
+	}
+	if err := group.checkTerm(); err != nil {
+		return err
+	}
+
+	return group.acquireLease(group.masterTerm)
+}
@@ -0,0 +1,61 @@
+package exoip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+func TestLeaseHeldByOtherCached(t *testing.T) {
+	ours := "00000000-0000-0000-0000-000000000001"
+	theirs := "00000000-0000-0000-0000-000000000002"
+	now := time.Now()
+	expiry := now.Add(time.Minute)
+
+	reads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"listpublicipaddressesresponse": {"count": 1, "publicipaddress": [{
+			"id": %q, "ipaddress": "192.0.2.10", "iselastic": true, "tags": [
+				{"key": %q, "value": %q},
+				{"key": %q, "value": "3"},
+				{"key": %q, "value": %q}]}]}}`,
+			theirs, leaseHolderKey, theirs, leaseTermKey, leaseExpiryKey, expiry.UTC().Format(time.RFC3339)) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	group := testGroup(10, ours)
+	group.ElasticIP = net.ParseIP("192.0.2.10")
+	group.engine.client = egoscale.NewClient(server.URL, "key", "secret")
+	group.engine.Retry = RetryConfig{Attempts: 1, Timeout: time.Second}
+	group.engine.Interval = time.Second
+	group.engine.VirtualMachineID = egoscale.MustParseUUID(ours)
+
+	for i := 0; i < 3; i++ {
+		if held, why := group.leaseHeldByOther(now); !held {
+			t.Fatalf("lease not held by the other peer: %s", why)
+		}
+	}
+	if reads != 1 {
+		t.Errorf("got %d reads of the lease, want 1", reads)
+	}
+
+	// once its holder resigned, the lease is read again
+	group.forgetLease()
+	group.leaseHeldByOther(now)
+	if reads != 2 {
+		t.Errorf("got %d reads of the lease after forgetting it, want 2", reads)
+	}
+
+	// and as well when it is about to expire
+	group.leaseHeldByOther(expiry.Add(-time.Millisecond))
+	if reads != 3 {
+		t.Errorf("got %d reads of the lease about to expire, want 3", reads)
+	}
+}
@@ -0,0 +1,345 @@
+package exoip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+// Monitor observes the groups without taking part in them
+//
+// It decodes the advertisements it receives and asks the API which NICs
+// hold the EIPs. It never sends an advertisement nor alters anything.
+type Monitor struct {
+	client        *egoscale.Client
+	ListenAddress string
+	DeadTime      time.Duration
+	ZoneID        *egoscale.UUID
+	authKey       []byte
+	groups        map[byte]*monitoredGroup
+	groupIDs      []byte
+	mu            sync.Mutex
+}
+
+// monitoredGroup is the view of a group
+type monitoredGroup struct {
+	id        byte
+	elasticIP net.IP
+	peers     map[string]*Peer
+	holders   []string
+	polledAt  time.Time
+}
+
+// NewMonitor creates a monitor of the given groups
+//
+// The peers are considered dead when they didn't advertise during deadTime.
+// When authKey is not empty, only the signed advertisements are accepted.
+func NewMonitor(client *egoscale.Client, addr string, groups []GroupConfig, instanceID egoscale.UUID,
+	deadTime time.Duration, authKey []byte) *Monitor {
+
+	zoneID, _, err := fetchMyInfo(client, instanceID)
+	assertSuccessOrExit(err)
+
+	if len(authKey) == 0 {
+		authKey = nil
+	}
+
+	monitor := &Monitor{
+		client:        client,
+		ListenAddress: addr,
+		DeadTime:      deadTime,
+		ZoneID:        zoneID,
+		authKey:       authKey,
+		groups:        make(map[byte]*monitoredGroup),
+	}
+
+	for _, config := range groups {
+		if _, ok := monitor.groups[config.ID]; ok {
+			assertSuccessOrExit(fmt.Errorf("group %d is defined twice", config.ID))
+		}
+
+		monitor.groups[config.ID] = &monitoredGroup{
+			id:        config.ID,
+			elasticIP: canonicalIP(config.ElasticIP),
+			peers:     make(map[string]*Peer),
+			holders:   make([]string, 0),
+		}
+		monitor.groupIDs = append(monitor.groupIDs, config.ID)
+	}
+
+	return monitor
+}
+
+// NetworkLoop listens to the advertisements
+//
+// A "status" datagram is answered with the observed view, in JSON, and an
+// "info" one logs it. With a shared key, the status request must be signed
+// like the advertisements, without one it must come from the monitor host.
+func (monitor *Monitor) NetworkLoop() error {
+	serverAddr, err := net.ResolveUDPAddr("udp", monitor.ListenAddress)
+	assertSuccessOrExit(err)
+
+	serverConn, err := net.ListenUDP("udp", serverAddr)
+	assertSuccessOrExit(err)
+
+	Logger.Info("monitoring on %s", serverAddr)
+	buf := make([]byte, maxPayloadLength+authTagLength)
+	for {
+		n, addr, err := serverConn.ReadFromUDP(buf)
+		if err != nil {
+			Logger.Crit("network server died")
+			os.Exit(1)
+		}
+
+		if bytes.HasPrefix(buf[:n], []byte("status")) {
+			if err := authorizeRequest(monitor.authKey, addr, buf[:n], "status"); err != nil {
+				Logger.Warning("refused the status request from %s: %s", addr.IP, err)
+				continue
+			}
+
+			status, err := json.Marshal(monitor.Status())
+			if err != nil {
+				Logger.Warning("%s", err)
+				continue
+			}
+			serverConn.WriteToUDP(append(status, '\n'), addr) // nolint: errcheck, gosec
+			continue
+		}
+
+		if bytes.HasPrefix(buf[:n], []byte("info")) {
+			if err := authorizeRequest(monitor.authKey, addr, buf[:n], "info"); err != nil {
+				Logger.Warning("refused the info request from %s: %s", addr.IP, err)
+				continue
+			}
+			monitor.Info()
+			continue
+		}
+
+		data := buf[:n]
+		if monitor.authKey != nil {
+			data, err = verifyPayload(monitor.authKey, data)
+			if err != nil {
+				Logger.Warning("dropped unauthenticated payload from %s: %s", addr.IP, err)
+				continue
+			}
+		}
+
+		payload, err := NewPayload(data)
+		if err != nil {
+			Logger.Warning("unparseable payload: %s", err)
+			continue
+		}
+
+		monitor.observe(addr, payload)
+	}
+}
+
+// observe records the advertisement of a peer
+func (monitor *Monitor) observe(addr *net.UDPAddr, payload *Payload) {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	var group *monitoredGroup
+	for _, g := range monitor.groups {
+		if g.elasticIP.Equal(payload.IP) && (payload.Version == LegacyProtoVersion || g.id == payload.GroupID) {
+			group = g
+			break
+		}
+	}
+
+	if group == nil {
+		Logger.Warning("peer %s sent message for unknown group %d (%s)", addr.IP, payload.GroupID, payload.IP)
+		return
+	}
+
+	key := addr.IP.String()
+	peer, ok := group.peers[key]
+	if !ok {
+		Logger.Info("group %d: found peer %s (%s)", group.id, addr.IP, payload.Hostname)
+		peer = &Peer{UDPAddr: addr, Dead: true}
+		group.peers[key] = peer
+	}
+
+	if payload.Version != LegacyProtoVersion {
+		if err := peer.CheckFreshness(payload); err != nil {
+			peer.Replays++
+			Logger.Info("peer %s sent a stale payload: %s", addr.IP, err)
+			return
+		}
+	}
+
+	if payload.State != peer.State {
+		Logger.Info("group %d: peer %s is %s (priority %d, term %d)", group.id, addr.IP, stateName(payload.State), payload.Priority, payload.Term)
+	}
+
+	peer.Legacy = payload.Version == LegacyProtoVersion
+	peer.Priority = payload.Priority
+	peer.NicID = payload.NicID
+	peer.State = payload.State
+	peer.Interval = payload.Interval
+	peer.ConfigHash = payload.ConfigHash
+	peer.Hostname = payload.Hostname
+	peer.Features = payload.Features
+	peer.Resigned = payload.Resign
+	peer.DeadPeers = payload.DeadPeers
+	peer.Term = payload.Term
+	peer.LastSeen = time.Now()
+}
+
+// CheckPeers logs the peers that died or came back and the dual masters
+func (monitor *Monitor) CheckPeers() {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	now := time.Now()
+	for _, id := range monitor.groupIDs {
+		group := monitor.groups[id]
+
+		masters := make([]string, 0)
+		for _, peer := range group.peers {
+			dead := peer.Resigned || now.Sub(peer.LastSeen) > monitor.DeadTime
+			if dead != peer.Dead {
+				if dead {
+					Logger.Warning("group %d: peer %s last seen %s, considering dead", group.id, peer.UDPAddr.IP, peer.LastSeen.Format(time.RFC3339))
+				} else {
+					Logger.Info("group %d: peer %s is alive", group.id, peer.UDPAddr.IP)
+					peer.AliveSince = now
+				}
+				peer.Dead = dead
+			}
+
+			if !peer.Dead && peer.State == StateMaster {
+				masters = append(masters, peer.UDPAddr.IP.String())
+			}
+		}
+
+		if len(masters) > 1 {
+			sort.Strings(masters)
+			Logger.Warning("group %d: several masters: %s", group.id, strings.Join(masters, ", "))
+		}
+	}
+}
+
+// PollHolders asks the API which NICs hold the EIPs
+func (monitor *Monitor) PollHolders() error {
+	vms, err := monitor.client.List(&egoscale.VirtualMachine{ZoneID: monitor.ZoneID})
+	if err != nil {
+		return err
+	}
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	now := time.Now()
+	for _, id := range monitor.groupIDs {
+		group := monitor.groups[id]
+
+		holders := make([]string, 0)
+		for _, h := range findHolders(vms, group.elasticIP) {
+			holders = append(holders, h.String())
+		}
+		sort.Strings(holders)
+
+		if strings.Join(holders, ",") != strings.Join(group.holders, ",") || group.polledAt.IsZero() {
+			switch len(holders) {
+			case 0:
+				Logger.Warning("group %d: ip %s is held by nobody", group.id, group.elasticIP)
+			case 1:
+				Logger.Info("group %d: ip %s is held by %s", group.id, group.elasticIP, holders[0])
+			default:
+				Logger.Warning("group %d: ip %s is held by several nics: %s", group.id, group.elasticIP, strings.Join(holders, ", "))
+			}
+		}
+
+		group.holders = holders
+		group.polledAt = now
+	}
+
+	return nil
+}
+
+// PeerStatus is the observed view of a peer
+type PeerStatus struct {
+	Address  string    `json:"address"`
+	Hostname string    `json:"hostname"`
+	NicID    string    `json:"nic_id"`
+	Priority byte      `json:"priority"`
+	State    string    `json:"state"`
+	Term     uint64    `json:"term"`
+	Alive    bool      `json:"alive"`
+	Witness  bool      `json:"witness"`
+	LastSeen time.Time `json:"last_seen"`
+	Replays  uint64    `json:"replays"`
+}
+
+// GroupStatus is the observed view of a group
+type GroupStatus struct {
+	ID        byte          `json:"id"`
+	ElasticIP string        `json:"elastic_ip"`
+	Holders   []string      `json:"holders"`
+	PolledAt  time.Time     `json:"polled_at"`
+	Peers     []*PeerStatus `json:"peers"`
+}
+
+// Status returns the observed view of the groups
+func (monitor *Monitor) Status() []*GroupStatus {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	status := make([]*GroupStatus, 0, len(monitor.groupIDs))
+	for _, id := range monitor.groupIDs {
+		group := monitor.groups[id]
+
+		groupStatus := &GroupStatus{
+			ID:        group.id,
+			ElasticIP: group.elasticIP.String(),
+			Holders:   group.holders,
+			PolledAt:  group.polledAt,
+			Peers:     make([]*PeerStatus, 0, len(group.peers)),
+		}
+
+		for _, peer := range group.peers {
+			groupStatus.Peers = append(groupStatus.Peers, &PeerStatus{
+				Address:  peer.UDPAddr.IP.String(),
+				Hostname: peer.Hostname,
+				NicID:    peer.NicID.String(),
+				Priority: peer.Priority,
+				State:    stateName(peer.State),
+				Term:     peer.Term,
+				Alive:    !peer.Dead,
+				Witness:  peer.Features&FeatureWitness != 0,
+				LastSeen: peer.LastSeen,
+				Replays:  peer.Replays,
+			})
+		}
+		sort.Slice(groupStatus.Peers, func(i, j int) bool {
+			return groupStatus.Peers[i].Address < groupStatus.Peers[j].Address
+		})
+
+		status = append(status, groupStatus)
+	}
+
+	return status
+}
+
+// Info logs the observed view (for debugging)
+func (monitor *Monitor) Info() {
+	for _, group := range monitor.Status() {
+		Logger.Info("Group: %d", group.ID)
+		Logger.Info("Elastic IP: %s", group.ElasticIP)
+		Logger.Info("Holders: %s", strings.Join(group.Holders, ", "))
+		for _, peer := range group.Peers {
+			Logger.Info("Peer: %s (%s) nic: %s priority: %d state: %s term: %d alive: %v last seen: %s",
+				peer.Address, peer.Hostname, peer.NicID, peer.Priority, peer.State, peer.Term, peer.Alive,
+				peer.LastSeen.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package exoip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultNotifyTimeout is how long a notify script may run by default
+const DefaultNotifyTimeout = 10 * time.Second
+
+// notifyQueueLength is how many transitions may wait for their scripts
+const notifyQueueLength = 16
+
+// NotifyPolicy tells how the notify scripts affect the state transitions
+type NotifyPolicy int
+
+const (
+	// NotifyAsync runs the scripts after the transition without waiting for them
+	NotifyAsync NotifyPolicy = iota
+	// NotifyBlock runs the scripts after the transition and waits for them
+	NotifyBlock
+	// NotifyAbort runs the scripts before the transition, which is aborted if one fails
+	NotifyAbort
+)
+
+var notifyPolicies = map[string]NotifyPolicy{
+	"async": NotifyAsync,
+	"block": NotifyBlock,
+	"abort": NotifyAbort,
+}
+
+// ParseNotifyPolicy reads a policy: async, block or abort
+func ParseNotifyPolicy(policy string) (NotifyPolicy, error) {
+	p, ok := notifyPolicies[policy]
+	if !ok {
+		return NotifyAsync, fmt.Errorf("unknown notify policy %q (async, block or abort)", policy)
+	}
+	return p, nil
+}
+
+// NotifyConfig describes the scripts run on the state transitions
+type NotifyConfig struct {
+	Master string
+	Backup string
+	Fault  string
+	// Any is run on every transition, after the script of the new state
+	Any     string
+	Timeout time.Duration
+	Policy  NotifyPolicy
+}
+
+// scripts returns the scripts to run when entering the given state
+func (config NotifyConfig) scripts(state State) []string {
+	scripts := make([]string, 0, 2)
+
+	switch state {
+	case StateMaster:
+		scripts = append(scripts, config.Master)
+	case StateBackup:
+		scripts = append(scripts, config.Backup)
+	case StateFault:
+		scripts = append(scripts, config.Fault)
+	}
+	scripts = append(scripts, config.Any)
+
+	found := scripts[:0]
+	for _, script := range scripts {
+		if script != "" {
+			found = append(found, script)
+		}
+	}
+	return found
+}
+
+// notification is a transition whose scripts are to be run in the background
+type notification struct {
+	scripts  []string
+	from, to State
+	reason   string
+}
+
+// stateName returns the name of the state as given to the scripts, e.g. master
+func stateName(state State) string {
+	return strings.ToLower(strings.TrimPrefix(state.String(), "State"))
+}
+
+// notify runs the notify scripts of the transition
+//
+// Following the policy, the scripts are run in the background or waited
+// for, in which case the first failure is returned. In the background, the
+// transitions of the group are queued so that their scripts are run in
+// order, and never at the same time.
+func (group *Group) notify(from, to State, reason string) error {
+	config := group.engine.Notify
+	scripts := config.scripts(to)
+	if len(scripts) == 0 {
+		return nil
+	}
+
+	if config.Policy == NotifyAsync {
+		group.notifyOnce.Do(func() {
+			group.notifications = make(chan notification, notifyQueueLength)
+			go group.notifyLoop()
+		})
+		group.notifications <- notification{scripts: scripts, from: from, to: to, reason: reason}
+		return nil
+	}
+
+	for _, script := range scripts {
+		if err := group.runNotify(script, from, to, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyLoop runs the scripts of the queued transitions, one after the other
+func (group *Group) notifyLoop() {
+	for n := range group.notifications {
+		for _, script := range n.scripts {
+			group.runNotify(script, n.from, n.to, n.reason) // nolint: errcheck, gosec
+		}
+	}
+}
+
+// runNotify runs the given script and logs its output
+//
+// The script gets the old state, the new state, the EIP and the reason as
+// arguments, and as EXOIP_* environment variables.
+func (group *Group) runNotify(script string, from, to State, reason string) error {
+	timeout := group.engine.Notify.Timeout
+	if timeout <= 0 {
+		timeout = DefaultNotifyTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script, stateName(from), stateName(to), group.ElasticIP.String(), reason)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("EXOIP_GROUP=%d", group.ID),
+		fmt.Sprintf("EXOIP_OLD_STATE=%s", stateName(from)),
+		fmt.Sprintf("EXOIP_NEW_STATE=%s", stateName(to)),
+		fmt.Sprintf("EXOIP_ELASTIC_IP=%s", group.ElasticIP),
+		fmt.Sprintf("EXOIP_REASON=%s", reason),
+	)
+
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			Logger.Info("%s: %s", script, line)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	if err != nil {
+		Logger.Warning("group %d: notify script %s failed: %s", group.ID, script, err)
+		return fmt.Errorf("notify script %s failed: %s", script, err)
+	}
+
+	return nil
+}
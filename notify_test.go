@@ -0,0 +1,54 @@
+package exoip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyAsyncOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	// the backup script is slower than the master one
+	output := filepath.Join(dir, "states")
+	script := filepath.Join(dir, "notify")
+	content := "#!/bin/sh\n[ \"$2\" = backup ] && sleep 0.2\necho \"$2\" >> " + output + "\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	group := testGroup(10, "00000000-0000-0000-0000-000000000001")
+	group.engine.Notify = NotifyConfig{Any: script, Policy: NotifyAsync}
+
+	transitions := []State{StateBackup, StateMaster, StateBackup, StateMaster}
+	from := StateInit
+	for _, to := range transitions {
+		if err := group.notify(from, to, "test"); err != nil {
+			t.Fatal(err)
+		}
+		from = to
+	}
+
+	want := "backup\nmaster\nbackup\nmaster\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := ioutil.ReadFile(output)
+		if err == nil && len(got) >= len(want) {
+			if string(got) != want {
+				t.Errorf("got the scripts run as %q, want %q", strings.Fields(string(got)), strings.Fields(want))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the scripts didn't run in time, got %q", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
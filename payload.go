@@ -1,31 +1,88 @@
 package exoip
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/exoscale/egoscale"
 )
 
-const payloadLength = 24
+// LegacyProtoVersion version of the protocol spoken by exoip 0.4 and older
+const LegacyProtoVersion = "0201"
 
-// NewPayload builds a Payload from a raw buffer (length of 24)
+const legacyPayloadLength = 24
+
+// headerLength is the size of the fixed part of a payload
+const headerLength = 54
+
+// maxPayloadLength is the size of the largest payload we accept
+const maxPayloadLength = 1024
+
+// maxDeadPeers is the number of dead peers advertised at most
+const maxDeadPeers = 32
+
+// Types of the payload options
+const (
+	optionState      byte = 1
+	optionGroup      byte = 2
+	optionInterval   byte = 3
+	optionConfigHash byte = 4
+	optionHostname   byte = 5
+	optionFeatures   byte = 6
+	optionResign     byte = 7
+	optionDeadPeers  byte = 8
+	optionTerm       byte = 9
+)
+
+// Features represents the capabilities advertised by a peer
+type Features uint32
+
+const (
+	// FeatureAuthentication means that the advertisements are signed
+	FeatureAuthentication Features = 1 << iota
+	// FeatureWitness means that the sender votes but never holds the EIP
+	FeatureWitness
+)
+
+// NewPayload builds a Payload from a raw buffer
 //
 // The layout of the payload is as follows:
 //
-//      2bytes  2bytes      4 bytes
-//     ┏━━━━━━━┳━━━━━━━┳━━━━━━━━━━━━━━━┓
-//     ┃ PROTO ┃ PRIO  ┃    EIP        ┃            16 bytes
-//     ┣━━━━━━━┻━━━━━━━┻━━━━━━━━━━━━━━━┻━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓
+//      2bytes  2bytes  2bytes
+//     ┏━━━━━━━┳━━━━━━━┳━━━━━━━┓                              16 bytes
+//     ┃ PROTO ┃ PRIO  ┃  LEN  ┣━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓
+//     ┣━━━━━━━┻━━━━━━━┻━━━━━━━┛ EIP (IPv6 or IPv4-mapped IPv6 addr)  ┃
+//     ┣━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┫
 //     ┃ NicID (128bit UUID)                                          ┃
-//     ┗━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┛
+//     ┣━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┳━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┛
+//     ┃ BootID (64bit)                ┃
+//     ┣━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┫
+//     ┃ Sequence number (64bit)       ┃
+//     ┣━━━━━━┳━━━━━━┳━━━━━━━━━━━━━━━━━┛
+//     ┃ TYPE ┃ LEN  ┃ VALUE ...          options, repeated
+//     ┗━━━━━━┻━━━━━━┻━━━━━━━━━━━━━━━━━━
 //
+// LEN is the length of the whole payload, options included. The options
+// are the state, the group ID, the advertisement interval, the config hash,
+// the hostname and the feature flags of the sender. An empty resign option
+// tells that the sender is shutting down. The dead peers options list the
+// NicIDs of the peers the sender considers dead. The term is the newest
+// election term known by the sender. Unknown options are skipped so that
+// they can be added without bumping the protocol version.
+//
+// The payloads of the legacy protocol (0201) are understood as well.
 func NewPayload(buf []byte) (*Payload, error) {
+	if len(buf) < 4 {
+		return nil, errors.New("bad payload (too short)")
+	}
+
 	version := hex.EncodeToString(buf[0:2])
-	if ProtoVersion != version {
-		Logger.Warning(fmt.Sprintf("bad protocol version, got %v", version))
+	if version != ProtoVersion && version != LegacyProtoVersion {
+		Logger.Warning("bad protocol version, got %v", version)
 		return nil, errors.New("bad protocol version")
 	}
 
@@ -34,23 +91,214 @@ func NewPayload(buf []byte) (*Payload, error) {
 		return nil, errors.New("bad payload (priority should repeat)")
 	}
 
-	nicID, err := egoscale.ParseUUID(fmt.Sprintf(
-		"%s-%s-%s-%s-%s",
-		hex.EncodeToString(buf[8:12]),
-		hex.EncodeToString(buf[12:14]),
-		hex.EncodeToString(buf[14:16]),
-		hex.EncodeToString(buf[16:18]),
-		hex.EncodeToString(buf[18:24]),
-	))
+	if version == LegacyProtoVersion {
+		return newLegacyPayload(buf)
+	}
+
+	if len(buf) < headerLength || int(binary.BigEndian.Uint16(buf[4:6])) != len(buf) {
+		return nil, errors.New("bad payload (length mismatch)")
+	}
+
+	nicID, err := parseUUID(buf[22:38])
 	if err != nil {
 		return nil, err
 	}
 
 	payload := &Payload{
+		Version:  version,
 		NicID:    nicID,
 		Priority: buf[2],
-		IP:       net.IPv4(buf[4], buf[5], buf[6], buf[7]),
+		IP:       canonicalIP(append(net.IP(nil), buf[6:22]...)),
+		BootID:   binary.BigEndian.Uint64(buf[38:46]),
+		Sequence: binary.BigEndian.Uint64(buf[46:54]),
+	}
+
+	options := buf[headerLength:]
+	for len(options) > 0 {
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return nil, errors.New("bad payload (truncated option)")
+		}
+
+		value := options[2 : 2+int(options[1])]
+		if err := payload.setOption(options[0], value); err != nil {
+			return nil, err
+		}
+		options = options[2+len(value):]
 	}
 
 	return payload, nil
 }
+
+// newLegacyPayload builds a Payload from a 0201 raw buffer (length of 24)
+//
+// The layout of the payload is as follows:
+//
+//      2bytes  2bytes      4 bytes
+//     ┏━━━━━━━┳━━━━━━━┳━━━━━━━━━━━━━━━┓
+//     ┃ PROTO ┃ PRIO  ┃    EIP        ┃            16 bytes
+//     ┣━━━━━━━┻━━━━━━━┻━━━━━━━━━━━━━━━┻━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓
+//     ┃ NicID (128bit UUID)                                          ┃
+//     ┗━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┛
+//
+func newLegacyPayload(buf []byte) (*Payload, error) {
+	if len(buf) != legacyPayloadLength {
+		return nil, errors.New("bad payload (length mismatch)")
+	}
+
+	nicID, err := parseUUID(buf[8:24])
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &Payload{
+		Version:  LegacyProtoVersion,
+		NicID:    nicID,
+		Priority: buf[2],
+		IP:       net.IPv4(buf[4], buf[5], buf[6], buf[7]).To4(),
+	}
+
+	return payload, nil
+}
+
+// parseUUID reads a 128bit UUID
+func parseUUID(buf []byte) (*egoscale.UUID, error) {
+	return egoscale.ParseUUID(fmt.Sprintf(
+		"%s-%s-%s-%s-%s",
+		hex.EncodeToString(buf[0:4]),
+		hex.EncodeToString(buf[4:6]),
+		hex.EncodeToString(buf[6:8]),
+		hex.EncodeToString(buf[8:10]),
+		hex.EncodeToString(buf[10:16]),
+	))
+}
+
+// optionLength is the expected length of the fixed size options
+var optionLength = map[byte]int{
+	optionState:      1,
+	optionGroup:      1,
+	optionInterval:   4,
+	optionConfigHash: 8,
+	optionFeatures:   4,
+	optionResign:     0,
+	optionTerm:       8,
+}
+
+// setOption reads the value of the given option
+func (payload *Payload) setOption(option byte, value []byte) error {
+	if n, ok := optionLength[option]; ok && n != len(value) {
+		return fmt.Errorf("bad payload (option %d has length %d)", option, len(value))
+	}
+
+	switch option {
+	case optionState:
+		payload.State = State(value[0])
+	case optionGroup:
+		payload.GroupID = value[0]
+	case optionInterval:
+		payload.Interval = time.Duration(binary.BigEndian.Uint32(value)) * time.Millisecond
+	case optionConfigHash:
+		payload.ConfigHash = binary.BigEndian.Uint64(value)
+	case optionHostname:
+		payload.Hostname = string(value)
+	case optionFeatures:
+		payload.Features = Features(binary.BigEndian.Uint32(value))
+	case optionResign:
+		payload.Resign = true
+	case optionTerm:
+		payload.Term = binary.BigEndian.Uint64(value)
+	case optionDeadPeers:
+		if len(value)%16 != 0 {
+			return fmt.Errorf("bad payload (option %d has length %d)", option, len(value))
+		}
+		for i := 0; i < len(value); i += 16 {
+			nicID, err := parseUUID(value[i : i+16])
+			if err != nil {
+				return err
+			}
+			payload.DeadPeers = append(payload.DeadPeers, nicID)
+		}
+	}
+
+	return nil
+}
+
+// Marshal encodes the payload following its version
+func (payload *Payload) Marshal() ([]byte, error) {
+	protobuf, err := hex.DecodeString(payload.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.Version == LegacyProtoVersion {
+		ip := payload.IP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("ip %s cannot be sent using the legacy protocol", payload.IP)
+		}
+
+		buf := make([]byte, legacyPayloadLength)
+		copy(buf[0:2], protobuf)
+		buf[2] = payload.Priority
+		buf[3] = payload.Priority
+		copy(buf[4:8], ip)
+		copy(buf[8:24], payload.NicID.UUID[:])
+		return buf, nil
+	}
+
+	buf := make([]byte, headerLength, maxPayloadLength)
+	copy(buf[0:2], protobuf)
+	buf[2] = payload.Priority
+	buf[3] = payload.Priority
+	copy(buf[6:22], payload.IP.To16())
+	copy(buf[22:38], payload.NicID.UUID[:])
+	binary.BigEndian.PutUint64(buf[38:46], payload.BootID)
+	binary.BigEndian.PutUint64(buf[46:54], payload.Sequence)
+
+	buf = append(buf, optionState, 1, byte(payload.State))
+	buf = append(buf, optionGroup, 1, payload.GroupID)
+	buf = appendUint32Option(buf, optionInterval, uint32(payload.Interval/time.Millisecond))
+	buf = appendUint64Option(buf, optionConfigHash, payload.ConfigHash)
+	buf = appendUint32Option(buf, optionFeatures, uint32(payload.Features))
+	buf = appendUint64Option(buf, optionTerm, payload.Term)
+	if payload.Resign {
+		buf = append(buf, optionResign, 0)
+	}
+	// an option holds up to 15 NicIDs, more are spread over several options
+	deadPeers := payload.DeadPeers
+	if len(deadPeers) > maxDeadPeers {
+		deadPeers = deadPeers[:maxDeadPeers]
+	}
+	for i := 0; i < len(deadPeers); i += 15 {
+		nicIDs := deadPeers[i:]
+		if len(nicIDs) > 15 {
+			nicIDs = nicIDs[:15]
+		}
+		buf = append(buf, optionDeadPeers, byte(16*len(nicIDs)))
+		for _, nicID := range nicIDs {
+			buf = append(buf, nicID.UUID[:]...)
+		}
+	}
+	if hostname := payload.Hostname; hostname != "" {
+		if len(hostname) > 255 {
+			hostname = hostname[:255]
+		}
+		buf = append(buf, optionHostname, byte(len(hostname)))
+		buf = append(buf, hostname...)
+	}
+
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(buf)))
+	return buf, nil
+}
+
+// appendUint32Option appends a 32bit option to buf
+func appendUint32Option(buf []byte, option byte, value uint32) []byte {
+	buf = append(buf, option, 4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], value)
+	return buf
+}
+
+// appendUint64Option appends a 64bit option to buf
+func appendUint64Option(buf []byte, option byte, value uint64) []byte {
+	buf = append(buf, option, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], value)
+	return buf
+}
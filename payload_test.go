@@ -0,0 +1,166 @@
+package exoip
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+func testPayload() *Payload {
+	return &Payload{
+		Version:    ProtoVersion,
+		Priority:   10,
+		GroupID:    3,
+		IP:         net.ParseIP("2001:db8::1"),
+		NicID:      egoscale.MustParseUUID("6a3e1d8e-6d0a-4f3c-8c1e-3b8f5a8a8d01"),
+		BootID:     1234,
+		Sequence:   42,
+		State:      StateMaster,
+		Interval:   500 * time.Millisecond,
+		ConfigHash: 0xdeadbeef,
+		Hostname:   "exoip-1",
+		Features:   FeatureAuthentication | FeatureWitness,
+		Resign:     true,
+		DeadPeers: []*egoscale.UUID{
+			egoscale.MustParseUUID("6a3e1d8e-6d0a-4f3c-8c1e-3b8f5a8a8d02"),
+		},
+		Term: 7,
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	payload := testPayload()
+
+	buf, err := payload.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := NewPayload(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, payload) {
+		t.Errorf("got %+v, want %+v", got, payload)
+	}
+}
+
+func TestPayloadManyDeadPeers(t *testing.T) {
+	payload := testPayload()
+	payload.DeadPeers = nil
+	for i := 0; i < maxDeadPeers+1; i++ {
+		payload.DeadPeers = append(payload.DeadPeers, egoscale.MustParseUUID("6a3e1d8e-6d0a-4f3c-8c1e-3b8f5a8a8d02"))
+	}
+
+	buf, err := payload.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := NewPayload(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.DeadPeers) != maxDeadPeers {
+		t.Errorf("got %d dead peers, want %d", len(got.DeadPeers), maxDeadPeers)
+	}
+}
+
+func TestLegacyPayloadRoundTrip(t *testing.T) {
+	payload := &Payload{
+		Version:  LegacyProtoVersion,
+		Priority: 10,
+		IP:       net.ParseIP("192.0.2.1").To4(),
+		NicID:    egoscale.MustParseUUID("6a3e1d8e-6d0a-4f3c-8c1e-3b8f5a8a8d01"),
+	}
+
+	buf, err := payload.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != legacyPayloadLength {
+		t.Fatalf("got a legacy payload of %d bytes, want %d", len(buf), legacyPayloadLength)
+	}
+
+	got, err := NewPayload(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, payload) {
+		t.Errorf("got %+v, want %+v", got, payload)
+	}
+}
+
+func TestLegacyPayloadIPv6(t *testing.T) {
+	payload := testPayload()
+	payload.Version = LegacyProtoVersion
+
+	if _, err := payload.Marshal(); err == nil {
+		t.Error("an IPv6 address was sent using the legacy protocol")
+	}
+}
+
+func TestPayloadUnknownOption(t *testing.T) {
+	payload := testPayload()
+
+	buf, err := payload.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, 200, 3, 1, 2, 3)
+	buf[4], buf[5] = byte(len(buf)>>8), byte(len(buf))
+
+	got, err := NewPayload(buf)
+	if err != nil {
+		t.Fatalf("unknown option not skipped: %s", err)
+	}
+	if !reflect.DeepEqual(got, payload) {
+		t.Errorf("got %+v, want %+v", got, payload)
+	}
+}
+
+func TestPayloadErrors(t *testing.T) {
+	valid, err := testPayload().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with the length fixed, so that only the options are wrong
+	withOptions := func(options ...byte) []byte {
+		buf := append(append([]byte(nil), valid[:headerLength]...), options...)
+		buf[4], buf[5] = byte(len(buf)>>8), byte(len(buf))
+		return buf
+	}
+
+	badVersion := append([]byte(nil), valid...)
+	badVersion[1] = 0x99
+
+	badPriority := append([]byte(nil), valid...)
+	badPriority[3]++
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"too short", valid[:3]},
+		{"bad version", badVersion},
+		{"priority not repeated", badPriority},
+		{"truncated header", valid[:headerLength-1]},
+		{"length mismatch", valid[:len(valid)-1]},
+		{"truncated option header", withOptions(optionState)},
+		{"truncated option value", withOptions(optionHostname, 5, 'a')},
+		{"bad option length", withOptions(optionState, 2, 1, 1)},
+		{"bad dead peers length", withOptions(optionDeadPeers, 3, 1, 2, 3)},
+		{"legacy length mismatch", []byte{0x02, 0x01, 10, 10, 192, 0, 2, 1}},
+	}
+
+	for _, tt := range tests {
+		if payload, err := NewPayload(tt.buf); err == nil {
+			t.Errorf("%s: got %+v, want an error", tt.name, payload)
+		}
+	}
+}
@@ -3,27 +3,13 @@ package exoip
 import (
 	"fmt"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/exoscale/egoscale"
 )
 
-// NewPeer creates a new peer
-func NewPeer(listenAddress string, raddr *net.UDPAddr, id, nicID egoscale.UUID) *Peer {
-	var laddr *net.UDPAddr
-
-	i := strings.IndexRune(listenAddress, ':')
-	if i > 0 {
-		local := listenAddress[0:i]
-		var err error
-		laddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:0", local))
-		assertSuccessOrExit(err)
-	}
-
-	conn, err := net.DialUDP("udp", laddr, raddr)
-	assertSuccessOrExit(err)
-
+// NewPeer creates a new peer, advertised to over the given connection
+func NewPeer(conn *net.UDPConn, raddr *net.UDPAddr, id, nicID egoscale.UUID) *Peer {
 	return &Peer{
 		VirtualMachineID: &id,
 		UDPAddr:          raddr,
@@ -33,6 +19,28 @@ func NewPeer(listenAddress string, raddr *net.UDPAddr, id, nicID egoscale.UUID)
 	}
 }
 
+// CheckFreshness accepts the payload if it is newer than the last one seen
+//
+// A payload with a newer BootID means the peer has restarted, its sequence
+// numbers start over. A payload from an older boot, or with a sequence
+// number that is not greater than the last one seen, is a replay.
+func (peer *Peer) CheckFreshness(payload *Payload) error {
+	switch {
+	case payload.BootID < peer.BootID:
+		return fmt.Errorf("boot ID %d is older than %d", payload.BootID, peer.BootID)
+	case payload.BootID > peer.BootID:
+		if peer.BootID != 0 {
+			Logger.Info("peer %s has restarted (boot ID %d)", peer.UDPAddr.IP, payload.BootID)
+		}
+		peer.BootID = payload.BootID
+	case payload.Sequence <= peer.Sequence:
+		return fmt.Errorf("sequence number %d is not greater than %d", payload.Sequence, peer.Sequence)
+	}
+
+	peer.Sequence = payload.Sequence
+	return nil
+}
+
 // Send writes the given buf to the connection
 func (peer *Peer) Send(buf []byte) (int, error) {
 	return peer.conn.Write(buf)
@@ -40,10 +48,26 @@ func (peer *Peer) Send(buf []byte) (int, error) {
 
 // Info logs the current state (for debugging)
 func (peer *Peer) Info() {
-	Logger.Info(fmt.Sprintf("\tVirtualMachine ID: %s", peer.VirtualMachineID))
-	Logger.Info(fmt.Sprintf("\tNic ID: %s", peer.NicID))
-	Logger.Info(fmt.Sprintf("\tAddress: %s", peer.UDPAddr))
-	Logger.Info(fmt.Sprintf("\tDead: %v", peer.Dead))
-	Logger.Info(fmt.Sprintf("\tPriority: %d", peer.Priority))
-	Logger.Info(fmt.Sprintf("\tLast Seen: %s", peer.LastSeen.Format(time.RFC3339)))
+	Logger.Info("\tVirtualMachine ID: %s", peer.VirtualMachineID)
+	Logger.Info("\tHostname: %s", peer.Hostname)
+	Logger.Info("\tNic ID: %s", peer.NicID)
+	Logger.Info("\tAddress: %s", peer.UDPAddr)
+	Logger.Info("\tDead: %v", peer.Dead)
+	Logger.Info("\tResigned: %v", peer.Resigned)
+	Logger.Info("\tDead peers: %s", peer.DeadPeers)
+	Logger.Info("\tPriority: %d", peer.Priority)
+	Logger.Info("\tState: %s", peer.State)
+	Logger.Info("\tTerm: %d", peer.Term)
+	Logger.Info("\tLegacy protocol: %v", peer.Legacy)
+	Logger.Info("\tInterval: %s", peer.Interval)
+	Logger.Info("\tConfig hash: %016x", peer.ConfigHash)
+	Logger.Info("\tFeatures: %#x", uint32(peer.Features))
+	Logger.Info("\tLast Seen: %s", peer.LastSeen.Format(time.RFC3339))
+	Logger.Info("\tAlive Since: %s", peer.AliveSince.Format(time.RFC3339))
+	if !peer.QuarantinedUntil.IsZero() {
+		Logger.Info("\tQuarantined Until: %s", peer.QuarantinedUntil.Format(time.RFC3339))
+	}
+	Logger.Info("\tBoot ID: %d", peer.BootID)
+	Logger.Info("\tSequence: %d", peer.Sequence)
+	Logger.Info("\tReplays: %d", peer.Replays)
 }
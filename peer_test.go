@@ -0,0 +1,50 @@
+package exoip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckFreshness(t *testing.T) {
+	deadTime := 3 * time.Second
+
+	// the last payload was seen lastSeen ago, with the boot ID 10 and the sequence 5
+	tests := []struct {
+		name     string
+		lastSeen time.Duration
+		bootID   uint64
+		sequence uint64
+		fresh    bool
+	}{
+		{"next sequence", 0, 10, 6, true},
+		{"replayed sequence", 0, 10, 5, false},
+		{"older sequence", 0, 10, 4, false},
+		{"restart", 0, 11, 1, true},
+		{"older boot", 0, 9, 100, false},
+		{"older boot after the dead time", 2 * deadTime, 9, 1, false},
+		{"older boot, newer sequence, after the dead time", 2 * deadTime, 9, 100, false},
+	}
+
+	for _, tt := range tests {
+		peer := &Peer{
+			UDPAddr:  &net.UDPAddr{IP: net.ParseIP("192.0.2.1")},
+			BootID:   10,
+			Sequence: 5,
+			LastSeen: time.Now().Add(-tt.lastSeen),
+		}
+		payload := &Payload{BootID: tt.bootID, Sequence: tt.sequence}
+
+		err := peer.CheckFreshness(payload)
+		if fresh := err == nil; fresh != tt.fresh {
+			t.Errorf("%s: got fresh %v (%v), want %v", tt.name, fresh, err, tt.fresh)
+			continue
+		}
+		if tt.fresh && (peer.BootID != tt.bootID || peer.Sequence != tt.sequence) {
+			t.Errorf("%s: got boot ID %d and sequence %d, want %d and %d", tt.name, peer.BootID, peer.Sequence, tt.bootID, tt.sequence)
+		}
+		if !tt.fresh && (peer.BootID != 10 || peer.Sequence != 5) {
+			t.Errorf("%s: a replay changed the boot ID to %d and the sequence to %d", tt.name, peer.BootID, peer.Sequence)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package exoip
+
+import (
+	"fmt"
+
+	"github.com/exoscale/egoscale"
+)
+
+// Reconcile looks for the EIPs on the NICs of the whole zone
+//
+// The virtual machines are listed once for all the groups.
+func (engine *Engine) Reconcile() error {
+	vms, err := engine.list(&egoscale.VirtualMachine{ZoneID: engine.ZoneID})
+	if err != nil {
+		return fmt.Errorf("could not list the virtual machines of zone %s: %s", engine.ZoneID, err)
+	}
+
+	var lastErr error
+	for _, group := range engine.Groups() {
+		if err := group.reconcile(vms); err != nil {
+			Logger.Crit("group %d: %s", group.ID, err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// reconcile makes sure that the EIP is only held by the master
+//
+// Any NIC holding the EIP besides ours is reported. When we are master,
+// the EIP is attached back to our NIC if needed, and once the NIC shows
+// it, removed from those NICs, unless another peer claims to be
+// master as well: the dual master is resolved by the election first. The
+// state lock is held meanwhile, and we make sure that we may still remove
+// the EIP before each removal.
+func (group *Group) reconcile(vms []interface{}) error {
+	engine := group.engine
+
+	group.stateMu.Lock()
+	defer group.stateMu.Unlock()
+
+	others := make([]holder, 0)
+	mine := false
+	for _, h := range findHolders(vms, group.ElasticIP) {
+		if h.NicID.Equal(*engine.NicID) {
+			mine = true
+			continue
+		}
+		others = append(others, h)
+	}
+
+	if group.State == StateMaster && !mine {
+		group.Drifts++
+		Logger.Warning("group %d: master but ip %s is not on our nic %s", group.ID, group.ElasticIP, engine.NicID)
+	}
+	if group.State != StateMaster && mine {
+		group.Drifts++
+		Logger.Warning("group %d: %s but ip %s is on our nic %s", group.ID, group.State, group.ElasticIP, engine.NicID)
+	}
+	for _, h := range others {
+		group.Drifts++
+		Logger.Warning("group %d: ip %s is held by %s", group.ID, group.ElasticIP, h)
+	}
+
+	if group.State != StateMaster || engine.Witness {
+		return nil
+	}
+
+	// the EIP must be ours again before it is taken from the others
+	if !mine {
+		if err := group.mayEvict(); err != nil {
+			return err
+		}
+
+		if err := group.ObtainNic(*engine.NicID); err != nil {
+			return fmt.Errorf("could not take ip %s back, leaving the other nics alone: %s", group.ElasticIP, err)
+		}
+	}
+
+	var lastErr error
+	for _, h := range others {
+		if err := group.mayEvict(); err != nil {
+			return err
+		}
+
+		done := engine.nicHolds(*h.VirtualMachine.ID, *h.NicID, group.ElasticIP, false)
+		if err := engine.booleanRequest(&egoscale.RemoveIPFromNic{ID: h.AddressID}, done); err != nil {
+			Logger.Crit("could not remove ip %s from %s (term %d): %s", group.ElasticIP, h, group.term(), err)
+			lastErr = err
+			continue
+		}
+		Logger.Info("released ip %s from %s (term %d)", group.ElasticIP, h, group.term())
+	}
+
+	return lastErr
+}
+
+// mayEvict tells if we may remove the EIP from the other NICs
+//
+// We must be the master of the newest term, and no other peer may claim to
+// be master.
+func (group *Group) mayEvict() error {
+	if group.State != StateMaster {
+		return fmt.Errorf("not master anymore, leaving ip %s alone", group.ElasticIP)
+	}
+
+	if err := group.checkTerm(); err != nil {
+		return err
+	}
+
+	group.peersMu.RLock()
+	defer group.peersMu.RUnlock()
+
+	for _, peer := range group.peers {
+		if !peer.Dead && peer.State == StateMaster {
+			return fmt.Errorf("peer %s claims to be master too, leaving ip %s alone", peer.UDPAddr.IP, group.ElasticIP)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package exoip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+func TestReconcileObtainFirst(t *testing.T) {
+	ours := "00000000-0000-0000-0000-000000000001"
+	theirs := "00000000-0000-0000-0000-000000000002"
+	ip := net.ParseIP("192.0.2.10")
+
+	// the API refuses to attach the ip back
+	commands := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		command := r.URL.Query().Get("command")
+		commands = append(commands, command)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(431)
+		fmt.Fprint(w, `{"addiptovmnicresponse": {"errorcode": 431, "errortext": "refused"}}`) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	group := testGroup(10, ours)
+	group.State = StateMaster
+	group.ElasticIP = ip
+	group.engine.client = egoscale.NewClient(server.URL, "key", "secret")
+	group.engine.Retry = RetryConfig{Attempts: 1, Timeout: time.Second}
+	group.engine.VirtualMachineID = egoscale.MustParseUUID(ours)
+
+	vm := &egoscale.VirtualMachine{
+		ID: egoscale.MustParseUUID(theirs),
+		Nic: []egoscale.Nic{{
+			ID:          egoscale.MustParseUUID(theirs),
+			SecondaryIP: []egoscale.NicSecondaryIP{{ID: egoscale.MustParseUUID(theirs), IPAddress: ip}},
+		}},
+	}
+
+	if err := group.reconcile([]interface{}{vm}); err == nil {
+		t.Error("reconciled while the ip couldn't be attached back")
+	}
+	for _, command := range commands {
+		if command == "removeIpFromNic" {
+			t.Errorf("ip removed from the other nic, got commands %v", commands)
+		}
+	}
+	if len(commands) == 0 || commands[0] != "addIpToNic" {
+		t.Errorf("ip not attached back first, got commands %v", commands)
+	}
+}
@@ -0,0 +1,309 @@
+package exoip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+// Defaults of the API calls
+const (
+	DefaultAPIAttempts = 3
+	DefaultAPITimeout  = 30 * time.Second
+	DefaultAPIBreaker  = 5
+)
+
+// Bounds of the backoff between two attempts
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 8 * time.Second
+)
+
+// breakerCooldown is how long the API is left alone once the breaker is open
+const breakerCooldown = 30 * time.Second
+
+// RetryConfig describes how the API calls are attempted
+type RetryConfig struct {
+	// Attempts is the number of attempts of a call failing transiently
+	Attempts int
+	// Timeout is the deadline of every attempt
+	Timeout time.Duration
+	// Breaker is the number of failures in a row opening the circuit breaker, 0 to disable
+	Breaker int
+}
+
+// circuitBreaker tracks whether the API is persistently down
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	lastErr   error
+	lastProbe time.Time
+}
+
+// retryable tells if the error is worth another attempt
+//
+// The network errors, the timeouts, the garbage sent by a proxy and the
+// CloudStack errors telling that the API is overloaded or a resource busy
+// are.
+func retryable(err error) bool {
+	var errResp *egoscale.ErrorResponse
+	if errors.As(err, &errResp) {
+		switch errResp.ErrorCode {
+		case egoscale.APILimitExceeded,
+			egoscale.InternalError,
+			egoscale.InsufficientCapacityError,
+			egoscale.ResourceUnavailableError,
+			egoscale.ResourceAllocationError,
+			egoscale.ResourceInUseError:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &netErr) || errors.As(err, &syntaxErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "content-type response expected")
+}
+
+// backoff returns the jittered delay before the given attempt, starting at 1
+func backoff(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 5 {
+		delay = minBackoff << uint(attempt-1)
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// applied tells, before another attempt of a mutation, whether the failed one went through nevertheless
+type applied func(ctx context.Context) (bool, error)
+
+// readOnly is the check of a read, which changes nothing and can always be attempted again
+func readOnly(context.Context) (bool, error) {
+	return false, nil
+}
+
+// retry runs the API call until it succeeds, fails for good or runs out of attempts
+//
+// A failed mutation may have been applied nevertheless, e.g. when the
+// response was lost: it is only submitted again once done tells that it
+// wasn't, and attempted once when done is nil. The first attempt gets the
+// full deadline, the next ones are made while the dead time isn't over,
+// so that a failing API doesn't stall the checks longer than the peers
+// wait for us. While the circuit breaker is open, a single attempt is
+// made, and none more once it opens.
+func (engine *Engine) retry(name string, call func(ctx context.Context) error, done applied) error {
+	config := engine.Retry
+	attempts := config.Attempts
+	if attempts < 1 || done == nil || engine.APIDown() {
+		attempts = 1
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultAPITimeout
+	}
+
+	start := time.Now()
+	// deadline is the context of a request, cut to what remains of the dead time unless first
+	deadline := func(first bool) (context.Context, context.CancelFunc) {
+		left := timeout
+		if remaining := engine.DeadTime - time.Since(start); !first && engine.DeadTime > 0 && remaining < left {
+			left = remaining
+		}
+		return context.WithTimeout(context.Background(), left)
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			delay := backoff(attempt - 1)
+			if engine.DeadTime > 0 && time.Since(start)+delay >= engine.DeadTime {
+				Logger.Warning("%s failed (attempt %d/%d): %s, no time left to retry", name, attempt-1, attempts, err)
+				break
+			}
+			Logger.Warning("%s failed (attempt %d/%d): %s, retrying in %s", name, attempt-1, attempts, err, delay.Round(time.Millisecond))
+			time.Sleep(delay)
+
+			ctx, cancel := deadline(false)
+			ok, checkErr := done(ctx)
+			cancel()
+			if checkErr != nil {
+				Logger.Warning("%s: could not tell whether the failed attempt went through: %s", name, checkErr)
+				break
+			}
+			if ok {
+				Logger.Info("%s went through despite the failure", name)
+				engine.apiSucceeded()
+				return nil
+			}
+		}
+
+		ctx, cancel := deadline(attempt == 1)
+		err = call(ctx)
+		cancel()
+
+		if err == nil {
+			engine.apiSucceeded()
+			return nil
+		}
+		if !retryable(err) {
+			return err
+		}
+		if engine.apiFailed(err) {
+			break
+		}
+	}
+
+	return fmt.Errorf("%s failed: %s", name, err)
+}
+
+// apiSucceeded closes the circuit breaker
+func (engine *Engine) apiSucceeded() {
+	breaker := &engine.breaker
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if engine.Retry.Breaker > 0 && breaker.failures >= engine.Retry.Breaker {
+		Logger.Info("the API is back, closing the circuit breaker")
+		engine.TriggerCheck()
+	}
+	breaker.failures = 0
+	breaker.lastErr = nil
+}
+
+// apiFailed counts a transient failure, opening the circuit breaker after too many
+//
+// It tells whether the circuit breaker is open.
+func (engine *Engine) apiFailed(err error) bool {
+	breaker := &engine.breaker
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.failures++
+	breaker.lastErr = err
+	if engine.Retry.Breaker > 0 && breaker.failures == engine.Retry.Breaker {
+		Logger.Crit("the API failed %d times in a row, opening the circuit breaker: %s", breaker.failures, err)
+		engine.TriggerCheck()
+	}
+	return engine.Retry.Breaker > 0 && breaker.failures >= engine.Retry.Breaker
+}
+
+// APIDown tells whether the circuit breaker is open
+func (engine *Engine) APIDown() bool {
+	down, _ := engine.apiDown()
+	return down
+}
+
+// apiDown tells whether the circuit breaker is open and why
+func (engine *Engine) apiDown() (bool, string) {
+	breaker := &engine.breaker
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if engine.Retry.Breaker == 0 || breaker.failures < engine.Retry.Breaker {
+		return false, ""
+	}
+	return true, fmt.Sprintf("the API is down: %s", breaker.lastErr)
+}
+
+// probeAPI checks, in the background, whether the API is back
+//
+// While the circuit breaker is open, the API is probed once every cooldown.
+func (engine *Engine) probeAPI(now time.Time) {
+	breaker := &engine.breaker
+	breaker.mu.Lock()
+	if now.Sub(breaker.lastProbe) < breakerCooldown {
+		breaker.mu.Unlock()
+		return
+	}
+	breaker.lastProbe = now
+	breaker.mu.Unlock()
+
+	go func() {
+		if _, err := engine.fetchMyNic(); err != nil {
+			Logger.Warning("the API is still down: %s", err)
+		}
+	}()
+}
+
+// request performs the command, retrying the transient failures unless done tells it went through
+//
+// The response is nil when a failed attempt turned out to be applied.
+func (engine *Engine) request(command egoscale.Command, done applied) (interface{}, error) {
+	var resp interface{}
+	err := engine.retry(engine.client.APIName(command), func(ctx context.Context) error {
+		var err error
+		resp, err = engine.client.RequestWithContext(ctx, command)
+		return err
+	}, done)
+	return resp, err
+}
+
+// booleanRequest performs the boolean command, retrying the transient failures unless done tells it went through
+func (engine *Engine) booleanRequest(command egoscale.Command, done applied) error {
+	return engine.retry(engine.client.APIName(command), func(ctx context.Context) error {
+		return engine.client.BooleanRequestWithContext(ctx, command)
+	}, done)
+}
+
+// get fetches the resource, retrying the transient failures
+func (engine *Engine) get(ls egoscale.Listable) (interface{}, error) {
+	var resp interface{}
+	err := engine.retry(fmt.Sprintf("get %T", ls), func(ctx context.Context) error {
+		var err error
+		resp, err = engine.client.GetWithContext(ctx, ls)
+		return err
+	}, readOnly)
+	return resp, err
+}
+
+// list lists the resources, retrying the transient failures
+func (engine *Engine) list(ls egoscale.Listable) ([]interface{}, error) {
+	var resp []interface{}
+	err := engine.retry(fmt.Sprintf("list %T", ls), func(ctx context.Context) error {
+		var err error
+		resp, err = engine.client.ListWithContext(ctx, ls)
+		return err
+	}, readOnly)
+	return resp, err
+}
+
+// nicHolds returns the check of a mutation done once the NIC holds the EIP, or doesn't anymore
+func (engine *Engine) nicHolds(vmID, nicID egoscale.UUID, ip net.IP, held bool) applied {
+	return func(ctx context.Context) (bool, error) {
+		resp, err := engine.client.GetWithContext(ctx, egoscale.VirtualMachine{ID: &vmID})
+		if err != nil {
+			return false, err
+		}
+
+		return holds(resp.(*egoscale.VirtualMachine), nicID, ip) == held, nil
+	}
+}
+
+// vmStopped is the check of a stop, done once the virtual machine is stopping or stopped
+func (engine *Engine) vmStopped(vmID egoscale.UUID) applied {
+	return func(ctx context.Context) (bool, error) {
+		resp, err := engine.client.GetWithContext(ctx, egoscale.VirtualMachine{ID: &vmID})
+		if err != nil {
+			return false, err
+		}
+
+		state := resp.(*egoscale.VirtualMachine).State
+		return state == "Stopping" || state == "Stopped", nil
+	}
+}
@@ -0,0 +1,154 @@
+package exoip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/exoscale/egoscale"
+)
+
+func TestRetryable(t *testing.T) {
+	var syntaxErr error
+	if err := json.Unmarshal([]byte("<html>"), new(interface{})); err != nil {
+		syntaxErr = fmt.Errorf("decoding: %w", err)
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"api limit", &egoscale.ErrorResponse{ErrorCode: egoscale.APILimitExceeded}, true},
+		{"internal error", &egoscale.ErrorResponse{ErrorCode: egoscale.InternalError}, true},
+		{"resource in use", &egoscale.ErrorResponse{ErrorCode: egoscale.ResourceInUseError}, true},
+		{"param error", &egoscale.ErrorResponse{ErrorCode: egoscale.ParamError}, false},
+		{"network timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{"deadline", fmt.Errorf("request: %w", context.DeadlineExceeded), true},
+		{"not json", syntaxErr, true},
+		{"proxy", errors.New(`body content-type response expected "application/json", got "text/html"`), true},
+		{"other", errors.New("no such virtual machine"), false},
+	}
+
+	for _, tt := range tests {
+		if retryable := retryable(tt.err); retryable != tt.retryable {
+			t.Errorf("%s: got retryable %v, want %v", tt.name, retryable, tt.retryable)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay := minBackoff << uint(attempt-1)
+		if attempt >= 5 || delay > maxBackoff {
+			delay = maxBackoff
+		}
+
+		for i := 0; i < 100; i++ {
+			if got := backoff(attempt); got < delay/2 || got > delay {
+				t.Fatalf("attempt %d: got a backoff of %s, want %s to %s", attempt, got, delay/2, delay)
+			}
+		}
+	}
+}
+
+// transient is an error worth another attempt
+var transient = &egoscale.ErrorResponse{ErrorCode: egoscale.InternalError}
+
+func testEngine(attempts int, deadTime time.Duration) *Engine {
+	return &Engine{
+		DeadTime: deadTime,
+		Retry:    RetryConfig{Attempts: attempts, Timeout: time.Second},
+	}
+}
+
+// failing returns a call failing transiently the given number of times, and counting its calls
+func failing(failures int, calls *int) func(context.Context) error {
+	return func(context.Context) error {
+		*calls++
+		if *calls <= failures {
+			return transient
+		}
+		return nil
+	}
+}
+
+func TestRetryRead(t *testing.T) {
+	calls := 0
+	if err := testEngine(3, 0).retry("read", failing(2, &calls), readOnly); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	calls := 0
+	err := testEngine(3, 0).retry("read", func(context.Context) error {
+		calls++
+		return errors.New("no such virtual machine")
+	}, readOnly)
+	if err == nil || calls != 1 {
+		t.Errorf("got %d calls and error %v, want 1 and an error", calls, err)
+	}
+}
+
+func TestRetryMutation(t *testing.T) {
+	tests := []struct {
+		name    string
+		applied bool
+		calls   int
+		checks  int
+	}{
+		{"lost response", true, 1, 1},
+		{"not applied", false, 2, 1},
+	}
+
+	for _, tt := range tests {
+		calls, checks := 0, 0
+		err := testEngine(2, 0).retry("mutation", failing(1, &calls), func(context.Context) (bool, error) {
+			checks++
+			return tt.applied, nil
+		})
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if calls != tt.calls || checks != tt.checks {
+			t.Errorf("%s: got %d calls and %d checks, want %d and %d", tt.name, calls, checks, tt.calls, tt.checks)
+		}
+	}
+}
+
+func TestRetryMutationUnknown(t *testing.T) {
+	calls := 0
+	err := testEngine(2, 0).retry("mutation", failing(1, &calls), func(context.Context) (bool, error) {
+		return false, transient
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("got %d calls and error %v, want 1 and an error", calls, err)
+	}
+}
+
+func TestRetryOnce(t *testing.T) {
+	calls := 0
+	if err := testEngine(3, 0).retry("reboot", failing(1, &calls), nil); err == nil || calls != 1 {
+		t.Errorf("got %d calls and error %v, want 1 and an error", calls, err)
+	}
+}
+
+func TestRetryDeadTime(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	err := testEngine(3, minBackoff/4).retry("read", failing(1, &calls), readOnly)
+	if err == nil || calls != 1 {
+		t.Errorf("got %d calls and error %v, want 1 and an error", calls, err)
+	}
+	if elapsed := time.Since(start); elapsed > minBackoff/4 {
+		t.Errorf("gave up after %s, past the dead time", elapsed)
+	}
+}
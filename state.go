@@ -2,7 +2,7 @@ package exoip
 
 //go:generate stringer -type=State
 
-// State represents the state : backup, master
+// State represents the state of a group: init, backup, master, ...
 type State int
 
 const (
@@ -12,4 +12,30 @@ const (
 	StateBackup
 	// StateMaster represents the master state
 	StateMaster
+	// StateInit represents the state during the initial hold off
+	StateInit
+	// StateFault represents the state when we cannot act upon the EIP
+	StateFault
+	// StateStopping represents the state of a shutting down engine
+	StateStopping
 )
+
+// transitions lists the states that can be reached from each state
+var transitions = map[State][]State{
+	StateUnknown:  {StateInit, StateBackup, StateMaster},
+	StateInit:     {StateBackup, StateMaster, StateFault, StateStopping},
+	StateBackup:   {StateMaster, StateFault, StateStopping},
+	StateMaster:   {StateBackup, StateFault, StateStopping},
+	StateFault:    {StateBackup, StateMaster, StateStopping},
+	StateStopping: {},
+}
+
+// CanTransitionTo tells if the state machine may go from state to next
+func (state State) CanTransitionTo(next State) bool {
+	for _, s := range transitions[state] {
+		if s == next {
+			return true
+		}
+	}
+	return false
+}
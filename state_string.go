@@ -4,9 +4,9 @@ package exoip
 
 import "strconv"
 
-const _State_name = "StateUnknownStateBackupStateMaster"
+const _State_name = "StateUnknownStateBackupStateMasterStateInitStateFaultStateStopping"
 
-var _State_index = [...]uint8{0, 12, 23, 34}
+var _State_index = [...]uint8{0, 12, 23, 34, 43, 53, 66}
 
 func (i State) String() string {
 	if i < 0 || i >= State(len(_State_index)-1) {
@@ -0,0 +1,31 @@
+package exoip
+
+import "testing"
+
+func TestCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to State
+		allowed  bool
+	}{
+		{StateUnknown, StateInit, true},
+		{StateInit, StateMaster, true},
+		{StateInit, StateBackup, true},
+		{StateBackup, StateMaster, true},
+		{StateMaster, StateBackup, true},
+		{StateMaster, StateFault, true},
+		{StateFault, StateBackup, true},
+		{StateBackup, StateStopping, true},
+		{StateUnknown, StateFault, false},
+		{StateBackup, StateInit, false},
+		{StateMaster, StateMaster, false},
+		{StateMaster, StateUnknown, false},
+		{StateStopping, StateMaster, false},
+		{StateStopping, StateInit, false},
+	}
+
+	for _, tt := range tests {
+		if allowed := tt.from.CanTransitionTo(tt.to); allowed != tt.allowed {
+			t.Errorf("%s to %s: got %v, want %v", tt.from, tt.to, allowed, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package exoip
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Tracker follows the health of something the EIP depends on
+//
+// It turns unhealthy after Fall failures in a row and healthy again after
+// Rise successes in a row. While unhealthy, it worsens the advertised
+// priority by its Weight or, when the weight is zero, puts the groups in
+// the fault state.
+type Tracker struct {
+	Name   string
+	Rise   int
+	Fall   int
+	Weight int
+	engine *Engine
+	mu     sync.Mutex
+	failed bool
+	streak int
+	detail string
+}
+
+// NewTracker creates a tracker influencing the elections of the engine
+func (engine *Engine) NewTracker(name string, rise, fall, weight int) *Tracker {
+	tracker := &Tracker{
+		Name:   name,
+		Rise:   rise,
+		Fall:   fall,
+		Weight: weight,
+		engine: engine,
+	}
+
+	engine.trackersMu.Lock()
+	engine.trackers = append(engine.trackers, tracker)
+	engine.trackersMu.Unlock()
+
+	return tracker
+}
+
+// Report records the result of the last probe
+//
+// When the health of the tracker changes, the states are checked right
+// away.
+func (tracker *Tracker) Report(ok bool, detail string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if ok != tracker.failed {
+		// the result confirms the current health
+		tracker.streak = 0
+		if !ok {
+			tracker.detail = detail
+		}
+		return
+	}
+
+	tracker.streak++
+	threshold := tracker.Fall
+	if tracker.failed {
+		threshold = tracker.Rise
+	}
+	if tracker.streak < threshold {
+		return
+	}
+
+	tracker.failed = !ok
+	tracker.streak = 0
+	tracker.detail = detail
+	if tracker.failed {
+		Logger.Warning("%s is failing: %s", tracker.Name, detail)
+	} else {
+		Logger.Info("%s is back to normal", tracker.Name)
+	}
+
+	tracker.engine.TriggerCheck()
+}
+
+// Failing returns whether the tracker is unhealthy and why
+func (tracker *Tracker) Failing() (bool, string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	return tracker.failed, tracker.detail
+}
+
+// Info logs the tracker current state (for debugging)
+func (tracker *Tracker) Info() {
+	failed, detail := tracker.Failing()
+	Logger.Info("Tracker: %s", tracker.Name)
+	Logger.Info("\tWeight: %d", tracker.Weight)
+	Logger.Info("\tFailing: %v", failed)
+	if failed {
+		Logger.Info("\tReason: %s", detail)
+	}
+}
+
+// health sums up the weights of the failing trackers
+//
+// The fault reason is set when a failing tracker has no weight.
+func (engine *Engine) health() (penalty int, fault string) {
+	engine.trackersMu.Lock()
+	defer engine.trackersMu.Unlock()
+
+	for _, tracker := range engine.trackers {
+		failed, detail := tracker.Failing()
+		if !failed {
+			continue
+		}
+
+		if tracker.Weight == 0 {
+			if fault == "" {
+				fault = fmt.Sprintf("%s is failing: %s", tracker.Name, detail)
+			}
+			continue
+		}
+		penalty += tracker.Weight
+	}
+
+	return penalty, fault
+}
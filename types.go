@@ -17,15 +17,45 @@ type Peer struct {
 	Dead             bool
 	Priority         byte
 	LastSeen         time.Time
+	AliveSince       time.Time
 	NicID            *egoscale.UUID
+	BootID           uint64
+	Sequence         uint64
+	Replays          uint64
+	Legacy           bool
+	State            State
+	Interval         time.Duration
+	ConfigHash       uint64
+	Hostname         string
+	Features         Features
+	Resigned         bool
+	DeadPeers        []*egoscale.UUID
+	Term             uint64
+	QuarantinedUntil time.Time
+	flaps            []time.Time
+	fencePending     bool
+	dualMaster       bool
+	samePriority     bool
 	conn             *net.UDPConn
 }
 
 // Payload represents a message of our protocol
 type Payload struct {
-	Priority byte
-	IP       net.IP
-	NicID    *egoscale.UUID
+	Version    string
+	Priority   byte
+	GroupID    byte
+	IP         net.IP
+	NicID      *egoscale.UUID
+	BootID     uint64
+	Sequence   uint64
+	State      State
+	Interval   time.Duration
+	ConfigHash uint64
+	Hostname   string
+	Features   Features
+	Resign     bool
+	DeadPeers  []*egoscale.UUID
+	Term       uint64
 }
 
 type wrappedLogger struct {
@@ -34,23 +64,83 @@ type wrappedLogger struct {
 	stdWriter    *log.Logger
 }
 
+// Group represents an Elastic IP watched over by a set of peers
+//
+// Like a VRRP virtual router, each group has its own priority, peers and
+// state.
+type Group struct {
+	Term           uint64 // accessed atomically, keep first for alignment
+	ID             byte
+	ElasticIP      net.IP
+	State          State
+	stateValue     int32 // the state, accessed atomically
+	priority       byte
+	noPreempt      bool
+	quorum         bool
+	preemptDelay   time.Duration
+	configHash     uint64
+	legacy         bool
+	masterTerm     uint64
+	masterSince    time.Time
+	holding        bool
+	leftMaster     bool
+	stateMu        sync.Mutex
+	penalty        float64
+	penaltyAt      time.Time
+	dampingMu      sync.Mutex
+	leaseExpiry    time.Time
+	lastLease      *lease
+	leaseMu        sync.Mutex
+	DualMasters    uint64
+	Drifts         uint64
+	detectedAt     time.Time
+	LastFailover   Failover
+	VerifyFailures uint64
+	notifications  chan notification
+	notifyOnce     sync.Once
+	SendBuf        []byte
+	peers          map[string]*Peer
+	peersMu        sync.RWMutex
+	engine         *Engine
+}
+
 // Engine represents the ExoIP engine structure
 type Engine struct {
+	AuthFailures      uint64 // accessed atomically, keep first for alignment
+	sequence          uint64 // accessed atomically, keep first for alignment
 	client            *egoscale.Client
 	listenPort        int
 	ListenAddress     string
-	DeadRatio         int
+	DeadTime          time.Duration
 	Interval          time.Duration
-	priority          byte
-	SendBuf           []byte
-	peers             map[string]*Peer
-	peersMu           sync.RWMutex
-	State             State
+	BootID            uint64
+	hostname          string
+	groups            map[byte]*Group
+	groupIDs          []byte
+	checkNow          chan struct{}
+	pingMu            sync.Mutex
+	conns             map[string]*net.UDPConn
+	connsMu           sync.Mutex
+	resigning         uint32 // accessed atomically
+	Notify            NotifyConfig
+	Damping           DampingConfig
+	Fence             FenceConfig
+	LeaseDuration     time.Duration
+	lastFence         time.Time
+	fenceMu           sync.Mutex
+	Retry             RetryConfig
+	breaker           circuitBreaker
+	Witness           bool
+	trackers          []*Tracker
+	trackersMu        sync.Mutex
+	isolation         *isolationCheck
 	LastSend          time.Time
 	InitHoldOff       time.Time
-	ElasticIP         net.IP
 	VirtualMachineID  *egoscale.UUID
 	SecurityGroupName string
 	NicID             *egoscale.UUID
 	ZoneID            *egoscale.UUID
+	authKey           []byte
+	authSuppressed    uint64
+	lastAuthWarning   time.Time
 }